@@ -1,14 +1,30 @@
 package common
 
 import (
+	"encoding/json"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
 )
 
 type EMFEvent struct {
-	AWS         *AWSMetadata           `json:"_aws"`
-	OtherFields map[string]interface{} `json:",inline"`
+	AWS *AWSMetadata `json:"_aws"`
+	// OtherFields are the metric values, dimensions and properties, written next to _aws
+	OtherFields map[string]interface{} `json:"-"`
+	// Tag is the fluent-bit tag of the records the event was aggregated from, used for routing
+	Tag string `json:"-"`
+}
+
+// MarshalJSON writes OtherFields as top level fields, which encoding/json has no tag for
+func (e EMFEvent) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(e.OtherFields)+1)
+	for key, value := range e.OtherFields {
+		fields[key] = value
+	}
+	fields["_aws"] = e.AWS
+	return json.Marshal(fields)
 }
 
 type AWSMetadata struct {
@@ -27,53 +43,132 @@ type ProjectionDefinition struct {
 	Metrics    []MetricDefinition `json:"Metrics"`
 }
 
-func merge(old []MetricDefinition, new []MetricDefinition) {
-	for _, attempt := range new {
-		exists := false
-		for _, v := range old {
-			if v.Name == attempt.Name && v.Unit == attempt.Unit {
-				exists = true
-				break
-			}
+// MaxMetricsPerDirective is the CloudWatch limit on metrics in one directive, merging starts a
+// new directive rather than going over it
+const MaxMetricsPerDirective = 100
+
+// clone deep copies the directive so merging it never changes the record it came from
+func (def ProjectionDefinition) clone() ProjectionDefinition {
+	dimensions := make([][]string, len(def.Dimensions))
+	for i, dimSet := range def.Dimensions {
+		dimensions[i] = append([]string{}, dimSet...)
+	}
+	return ProjectionDefinition{
+		Namespace:  def.Namespace,
+		Dimensions: dimensions,
+		Metrics:    append([]MetricDefinition{}, def.Metrics...),
+	}
+}
+
+// dimensionSetKey identifies a dimension set regardless of the order of its names
+func dimensionSetKey(dimSet []string) string {
+	sorted := append([]string{}, dimSet...)
+	sort.Strings(sorted)
+	// quoted so no name can be mistaken for the separator
+	var b strings.Builder
+	for _, name := range sorted {
+		b.WriteString(strconv.Quote(name))
+	}
+	return b.String()
+}
+
+// dimensionsKey identifies the dimension sets of a directive regardless of their order
+func dimensionsKey(dimensions [][]string) string {
+	keys := make([]string, len(dimensions))
+	for i, dimSet := range dimensions {
+		keys[i] = strconv.Quote(dimensionSetKey(dimSet))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "")
+}
+
+// Canonicalize removes duplicate dimension sets and metrics, keeping the first of each in order.
+// Metrics are identified by name alone, CloudWatch can't publish one name with two units
+func (def *ProjectionDefinition) Canonicalize() {
+	seenSets := make(map[string]bool, len(def.Dimensions))
+	dimensions := def.Dimensions[:0]
+	for _, dimSet := range def.Dimensions {
+		if key := dimensionSetKey(dimSet); !seenSets[key] {
+			seenSets[key] = true
+			dimensions = append(dimensions, dimSet)
 		}
-		if !exists {
-			old = append(old, attempt)
+	}
+	def.Dimensions = dimensions
+
+	seenMetrics := make(map[string]bool, len(def.Metrics))
+	metrics := def.Metrics[:0]
+	for _, metric := range def.Metrics {
+		if !seenMetrics[metric.Name] {
+			seenMetrics[metric.Name] = true
+			metrics = append(metrics, metric)
 		}
 	}
+	def.Metrics = metrics
+}
 
+// metric returns the directive's declaration of the metric, nil when it doesn't declare it
+func (def *ProjectionDefinition) metric(name string) *MetricDefinition {
+	if i := utils.Find(def.Metrics, func(m MetricDefinition) bool { return m.Name == name }); i != -1 {
+		return &def.Metrics[i]
+	}
+	return nil
 }
 
 // we can only merge if the namespaces match and the dimension sets match
 // even if the namespaces match, if the dimensions aren't the same we risk
 // emitting metrics under dimensions they weren't intended to be emitted under
-func (def *ProjectionDefinition) attemptMerge(new *ProjectionDefinition) bool {
-	if def.Namespace != new.Namespace {
-		return false
-	}
-	if utils.Every(def.Dimensions, func(val []string) bool {
-		return utils.Find(new.Dimensions, func(test []string) bool {
-			return strings.Join(val, ", ") == strings.Join(test, ", ")
-		}) != -1
-	}) {
-		merge(def.Metrics, new.Metrics)
-		return true
-	} else {
-		return false
-	}
+func (def *ProjectionDefinition) matches(other *ProjectionDefinition) bool {
+	return def.Namespace == other.Namespace && dimensionsKey(def.Dimensions) == dimensionsKey(other.Dimensions)
 }
 
+// Merge adds the directives of new into m without keeping references to it. Metrics are added to the first directive with the same
+// namespace and dimension sets that has room for them, anything left over starts a new directive
 func (m *AWSMetadata) Merge(new *AWSMetadata) {
 	m.Timestamp = new.Timestamp
 	for _, attempt := range new.CloudWatchMetrics {
-		merged := false
-		for _, v := range m.CloudWatchMetrics {
-			merged = v.attemptMerge(&attempt)
-			if merged {
-				break
+		attempt = attempt.clone()
+		attempt.Canonicalize()
+
+		var matching []int
+		for i := range m.CloudWatchMetrics {
+			if m.CloudWatchMetrics[i].matches(&attempt) {
+				matching = append(matching, i)
 			}
 		}
-		if !merged {
-			m.CloudWatchMetrics = append(m.CloudWatchMetrics, attempt)
+
+		var remaining []MetricDefinition
+		for _, metric := range attempt.Metrics {
+			var existing *MetricDefinition
+			for _, i := range matching {
+				if existing = m.CloudWatchMetrics[i].metric(metric.Name); existing != nil {
+					break
+				}
+			}
+			if existing != nil {
+				// the first unit declared for a metric wins, even when it's none
+				continue
+			}
+			added := false
+			for _, i := range matching {
+				if def := &m.CloudWatchMetrics[i]; len(def.Metrics) < MaxMetricsPerDirective {
+					def.Metrics = append(def.Metrics, metric)
+					added = true
+					break
+				}
+			}
+			if !added {
+				remaining = append(remaining, metric)
+			}
+		}
+
+		for start := 0; start < len(remaining); start += MaxMetricsPerDirective {
+			end := start + MaxMetricsPerDirective
+			if end > len(remaining) {
+				end = len(remaining)
+			}
+			split := attempt.clone()
+			split.Metrics = remaining[start:end]
+			m.CloudWatchMetrics = append(m.CloudWatchMetrics, split)
 		}
 	}
 }
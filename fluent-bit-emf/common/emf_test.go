@@ -0,0 +1,174 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func directive(namespace string, dimensions [][]string, metrics ...string) ProjectionDefinition {
+	def := ProjectionDefinition{Namespace: namespace, Dimensions: dimensions}
+	for _, name := range metrics {
+		def.Metrics = append(def.Metrics, MetricDefinition{Name: name})
+	}
+	return def
+}
+
+func withUnit(def ProjectionDefinition, unit string) ProjectionDefinition {
+	for i := range def.Metrics {
+		def.Metrics[i].Unit = unit
+	}
+	return def
+}
+
+func TestMerge(t *testing.T) {
+	service := [][]string{{"Service"}}
+	for _, tc := range []struct {
+		name     string
+		existing []ProjectionDefinition
+		new      []ProjectionDefinition
+		expected []ProjectionDefinition
+	}{
+		{
+			name:     "into empty",
+			new:      []ProjectionDefinition{directive("NS", service, "Latency")},
+			expected: []ProjectionDefinition{directive("NS", service, "Latency")},
+		},
+		{
+			name:     "new metric",
+			existing: []ProjectionDefinition{directive("NS", service, "Latency")},
+			new:      []ProjectionDefinition{directive("NS", service, "Errors", "Latency")},
+			expected: []ProjectionDefinition{directive("NS", service, "Latency", "Errors")},
+		},
+		{
+			name:     "known metric with another unit",
+			existing: []ProjectionDefinition{withUnit(directive("NS", service, "Latency"), "Microseconds")},
+			new:      []ProjectionDefinition{withUnit(directive("NS", service, "Latency"), "Milliseconds")},
+			expected: []ProjectionDefinition{withUnit(directive("NS", service, "Latency"), "Microseconds")},
+		},
+		{
+			name:     "known metric without a unit",
+			existing: []ProjectionDefinition{directive("NS", service, "Latency")},
+			new:      []ProjectionDefinition{withUnit(directive("NS", service, "Latency"), "Milliseconds")},
+			expected: []ProjectionDefinition{directive("NS", service, "Latency")},
+		},
+		{
+			name:     "different namespace",
+			existing: []ProjectionDefinition{directive("NS", service, "Latency")},
+			new:      []ProjectionDefinition{directive("Other", service, "Latency")},
+			expected: []ProjectionDefinition{directive("NS", service, "Latency"), directive("Other", service, "Latency")},
+		},
+		{
+			name:     "more dimension sets",
+			existing: []ProjectionDefinition{directive("NS", service, "Latency")},
+			new:      []ProjectionDefinition{directive("NS", [][]string{{"Service"}, {"Service", "Operation"}}, "Errors")},
+			expected: []ProjectionDefinition{
+				directive("NS", service, "Latency"),
+				directive("NS", [][]string{{"Service"}, {"Service", "Operation"}}, "Errors"),
+			},
+		},
+		{
+			name:     "fewer dimension sets",
+			existing: []ProjectionDefinition{directive("NS", [][]string{{"Service"}, {"Service", "Operation"}}, "Latency")},
+			new:      []ProjectionDefinition{directive("NS", service, "Errors")},
+			expected: []ProjectionDefinition{
+				directive("NS", [][]string{{"Service"}, {"Service", "Operation"}}, "Latency"),
+				directive("NS", service, "Errors"),
+			},
+		},
+		{
+			name:     "dimension sets in another order",
+			existing: []ProjectionDefinition{directive("NS", [][]string{{"Service"}, {"Service", "Operation"}}, "Latency")},
+			new:      []ProjectionDefinition{directive("NS", [][]string{{"Operation", "Service"}, {"Service"}}, "Errors")},
+			expected: []ProjectionDefinition{directive("NS", [][]string{{"Service"}, {"Service", "Operation"}}, "Latency", "Errors")},
+		},
+		{
+			name:     "no dimensions",
+			existing: []ProjectionDefinition{directive("NS", [][]string{}, "Latency")},
+			new:      []ProjectionDefinition{directive("NS", nil, "Errors")},
+			expected: []ProjectionDefinition{directive("NS", [][]string{}, "Latency", "Errors")},
+		},
+		{
+			name: "duplicates",
+			new:  []ProjectionDefinition{directive("NS", [][]string{{"Service"}, {"Service"}}, "Latency", "Errors", "Latency")},
+			expected: []ProjectionDefinition{
+				directive("NS", service, "Latency", "Errors"),
+			},
+		},
+		{
+			name:     "second matching directive",
+			existing: []ProjectionDefinition{directive("NS", service, "Latency"), directive("NS", service, "Errors")},
+			new:      []ProjectionDefinition{directive("NS", service, "Errors", "Faults")},
+			expected: []ProjectionDefinition{directive("NS", service, "Latency", "Faults"), directive("NS", service, "Errors")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &AWSMetadata{CloudWatchMetrics: tc.existing}
+			m.Merge(&AWSMetadata{Timestamp: 1700000000000, CloudWatchMetrics: tc.new})
+			if !reflect.DeepEqual(m.CloudWatchMetrics, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, m.CloudWatchMetrics)
+			}
+			if m.Timestamp != 1700000000000 {
+				t.Errorf("Expected the timestamp of the merged metadata, got %d", m.Timestamp)
+			}
+		})
+	}
+}
+
+func TestMerge_MetricLimit(t *testing.T) {
+	var names []string
+	for i := 0; i < MaxMetricsPerDirective+5; i++ {
+		names = append(names, fmt.Sprintf("Metric%d", i))
+	}
+	m := &AWSMetadata{CloudWatchMetrics: []ProjectionDefinition{directive("NS", nil, names[:MaxMetricsPerDirective-2]...)}}
+	m.Merge(&AWSMetadata{CloudWatchMetrics: []ProjectionDefinition{directive("NS", nil, names...)}})
+
+	if len(m.CloudWatchMetrics) != 2 {
+		t.Fatalf("Expected the metrics over the limit in a new directive, got %d directives", len(m.CloudWatchMetrics))
+	}
+	if first, second := len(m.CloudWatchMetrics[0].Metrics), len(m.CloudWatchMetrics[1].Metrics); first != MaxMetricsPerDirective || second != 5 {
+		t.Errorf("Expected %d and 5 metrics, got %d and %d", MaxMetricsPerDirective, first, second)
+	}
+
+	// a later record only fills the directives it matches
+	m.Merge(&AWSMetadata{CloudWatchMetrics: []ProjectionDefinition{directive("NS", nil, "Metric0", "Extra")}})
+	if len(m.CloudWatchMetrics) != 2 || m.CloudWatchMetrics[1].Metrics[5].Name != "Extra" {
+		t.Errorf("Expected Extra to be added to the directive with room, got %+v", m.CloudWatchMetrics[1].Metrics)
+	}
+}
+
+func TestMerge_NoAliasing(t *testing.T) {
+	new := &AWSMetadata{CloudWatchMetrics: []ProjectionDefinition{directive("NS", [][]string{{"Service"}}, "Latency")}}
+	m := &AWSMetadata{}
+	m.Merge(new)
+
+	new.CloudWatchMetrics[0].Dimensions[0][0] = "Changed"
+	new.CloudWatchMetrics[0].Metrics[0].Name = "Changed"
+	m.Merge(&AWSMetadata{CloudWatchMetrics: []ProjectionDefinition{directive("NS", [][]string{{"Service"}}, "Errors")}})
+
+	expected := []ProjectionDefinition{directive("NS", [][]string{{"Service"}}, "Latency", "Errors")}
+	if !reflect.DeepEqual(m.CloudWatchMetrics, expected) {
+		t.Errorf("Expected the merged metadata to be unaffected by the record, got %+v", m.CloudWatchMetrics)
+	}
+	if len(new.CloudWatchMetrics[0].Metrics) != 1 {
+		t.Errorf("Expected the record to be unaffected by later merges, got %+v", new.CloudWatchMetrics[0])
+	}
+}
+
+func TestEMFEvent_MarshalJSON(t *testing.T) {
+	event := EMFEvent{
+		AWS:         &AWSMetadata{Timestamp: 1700000000000, CloudWatchMetrics: []ProjectionDefinition{directive("NS", [][]string{{"Service"}}, "Latency")}},
+		OtherFields: map[string]interface{}{"Service": "api", "Latency": 12.5, "_aws": "ignored"},
+		Tag:         "app",
+	}
+	marshalled, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := `{"Latency":12.5,"Service":"api","_aws":{"Timestamp":1700000000000,"CloudWatchMetrics":[{"Namespace":"NS","Dimensions":[["Service"]],"Metrics":[{"Name":"Latency"}]}]}}`
+	if string(marshalled) != expected {
+		t.Errorf("Expected %s, got %s", expected, marshalled)
+	}
+}
@@ -1,6 +1,70 @@
 package common
 
-import "time"
+import (
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/dimension"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/histogram"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/metric"
+)
+
+// InvalidValues modes decide what happens to a metric value that isn't a number
+const (
+	// InvalidValuesDropRecord rejects the whole record, the default
+	InvalidValuesDropRecord = "drop_record"
+	// InvalidValuesDropMetric drops the bad metric and keeps the rest of the record
+	InvalidValuesDropMetric = "drop_metric"
+	// InvalidValuesCoerce turns anything that isn't a number into 0
+	InvalidValuesCoerce = "coerce"
+)
+
+// Validation actions for records that break the CloudWatch limits
+const (
+	ValidationFix      = "fix"
+	ValidationTruncate = "truncate"
+	ValidationReject   = "reject"
+	ValidationIgnore   = "ignore"
+)
+
+// UnitConflicts modes decide what happens when a series sees a metric in a different unit than before
+const (
+	// UnitConflictsConvert converts values to a canonical unit per quantity, splitting when the
+	// units measure different things, the default
+	UnitConflictsConvert = "convert"
+	// UnitConflictsSplit aggregates the metric in a separate series per unit
+	UnitConflictsSplit = "split"
+	// UnitConflictsReject drops the value
+	UnitConflictsReject = "reject"
+)
+
+// CardinalityOverflow modes decide what happens to new series over a cardinality limit
+const (
+	// CardinalityOverflowFold aggregates them into an overflow series with every dimension value
+	// replaced, the default
+	CardinalityOverflowFold = "fold"
+	// CardinalityOverflowDrop drops them
+	CardinalityOverflowDrop = "drop"
+)
+
+// Retention policies for properties that aren't metrics or dimensions
+const (
+	// RetainKey makes the property part of the series key, so each value is a separate series
+	RetainKey = "key"
+	// RetainLast keeps the last value seen in the series, the default
+	RetainLast = "last"
+	// RetainDistinct keeps every distinct value seen in the series as an array
+	RetainDistinct = "distinct"
+)
+
+// TimestampUnit values for numeric _aws.Timestamp values
+const (
+	// TimestampUnitAuto guesses the unit from the timestamp's magnitude, the default
+	TimestampUnitAuto         = "auto"
+	TimestampUnitSeconds      = "s"
+	TimestampUnitMilliseconds = "ms"
+	TimestampUnitMicroseconds = "us"
+	TimestampUnitNanoseconds  = "ns"
+)
 
 type PluginOptions struct {
 	OutputPath         string
@@ -9,4 +73,52 @@ type PluginOptions struct {
 	LogStreamName      string
 	CloudWatchEndpoint string
 	Protocol           string
+	BucketMeans        bool
+	SignificantDigits  int
+	HistogramRules     histogram.Rules
+	InvalidValues      string
+	TimestampUnit      string
+	// timestamps further than this from now are clamped, 0 disables clamping on that side
+	TimestampMaxPast   time.Duration
+	TimestampMaxFuture time.Duration
+	// TagDimension adds the fluent-bit tag as a dimension with this name when set
+	TagDimension string
+	// TagSeriesKey keeps records with different tags in different series
+	TagSeriesKey bool
+	// EmbeddedKeys are searched for an EMF document embedded as a JSON string when a record has no _aws
+	EmbeddedKeys []string
+	// DiagnosticSampleRate logs one in every this many dropped parts of records, 0 only counts them
+	DiagnosticSampleRate int
+	// rejected records are written to this file or log group and stream when set
+	DeadLetterPath          string
+	DeadLetterLogGroupName  string
+	DeadLetterLogStreamName string
+	// per flush limits on dead letters, 0 is unlimited
+	DeadLetterMaxRecords     int
+	DeadLetterMaxRecordBytes int
+	DeadLetterMaxBytes       int
+	// DecomposeDimensionSets aggregates every dimension set of a record as its own series, so
+	// rollups are aggregated across the dimensions they don't include
+	DecomposeDimensionSets bool
+	// UnitConflicts is the UnitConflicts mode
+	UnitConflicts string
+	// limits on the distinct series per aggregation period, overall, per namespace and per
+	// namespace and metric name, 0 is unlimited
+	MaxSeries             int
+	MaxSeriesPerNamespace int
+	MaxSeriesPerMetric    int
+	// CardinalityOverflow is the CardinalityOverflow mode
+	CardinalityOverflow string
+	// MetricRules drop, rename and move metrics between namespaces when records are parsed
+	MetricRules metric.Rules
+	// DropDimensions are globs of dimensions removed from every dimension set of a record
+	DropDimensions []string
+	// DimensionInjections add dimensions to every record, after TagDimension
+	DimensionInjections dimension.Injections
+	// DimensionRules rewrite dimension values before records are keyed into series
+	DimensionRules dimension.Rules
+	// RetainedProperties maps properties written to the output to their Retain policy
+	RetainedProperties map[string]string
+	// Validation maps each CloudWatch limit violation to a Validation action, nil disables validation
+	Validation map[string]string
 }
@@ -0,0 +1,158 @@
+// Package deadletter keeps the records the plugin rejects, along with why, so producers can
+// debug malformed EMF without verbose logging being turned on
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/flush"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/log"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// Letter is what's written to the sink for every rejected record
+type Letter struct {
+	Reason string `json:"reason"`
+	Tag    string `json:"tag"`
+	// Timestamp is the fluent-bit record time in epoch milliseconds
+	Timestamp int64 `json:"timestamp"`
+	// Record is the original record, or the whole event when it couldn't be decoded. It's its
+	// JSON cut to the size cap when Truncated is set
+	Record    interface{} `json:"record"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// Sink buffers letters until Flush, dropping any over the per flush limits
+type Sink struct {
+	mu      sync.Mutex
+	flusher flush.RawFlusher
+
+	maxRecords     int
+	maxRecordBytes int
+	maxBytes       int
+
+	pending      [][]byte
+	pendingBytes int
+	dropped      int
+}
+
+// NewSink returns nil when no dead letter destination is configured, a nil Sink discards everything
+func NewSink(options *common.PluginOptions) (*Sink, error) {
+	if options.DeadLetterPath == "" && options.DeadLetterLogGroupName == "" {
+		return nil, nil
+	}
+	flusher, err := flush.InitRawFlusher(&common.PluginOptions{
+		OutputPath:         options.DeadLetterPath,
+		LogGroupName:       options.DeadLetterLogGroupName,
+		LogStreamName:      options.DeadLetterLogStreamName,
+		CloudWatchEndpoint: options.CloudWatchEndpoint,
+		Protocol:           options.Protocol,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dead letter output: %w", err)
+	}
+	return newSink(flusher, options.DeadLetterMaxRecords, options.DeadLetterMaxRecordBytes, options.DeadLetterMaxBytes), nil
+}
+
+func newSink(flusher flush.RawFlusher, maxRecords int, maxRecordBytes int, maxBytes int) *Sink {
+	return &Sink{
+		flusher:        flusher,
+		maxRecords:     maxRecords,
+		maxRecordBytes: maxRecordBytes,
+		maxBytes:       maxBytes,
+	}
+}
+
+// Send queues a rejected record, or the whole event when it couldn't be decoded, 0 limits are unlimited
+func (s *Sink) Send(reason string, tag string, recordTime time.Time, record interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxRecords > 0 && len(s.pending) >= s.maxRecords {
+		s.dropped++
+		return
+	}
+
+	letter := Letter{Reason: reason, Tag: tag, Timestamp: recordTime.UnixMilli(), Record: utils.ToJSONValue(record)}
+	message, err := json.Marshal(letter)
+	if err != nil {
+		log.Warn().Printf("failed to marshal dead letter: %v\n", err)
+		s.dropped++
+		return
+	}
+	if s.maxRecordBytes > 0 && len(message) > s.maxRecordBytes {
+		// keep the start of the record as a string, shrinking it until the escaped letter fits
+		recordJSON, _ := json.Marshal(letter.Record)
+		letter.Truncated = true
+		keep := len(recordJSON) - (len(message) - s.maxRecordBytes)
+		for {
+			if keep < 0 {
+				keep = 0
+			}
+			letter.Record = string(recordJSON[:keep])
+			if message, err = json.Marshal(letter); err != nil {
+				s.dropped++
+				return
+			}
+			if len(message) <= s.maxRecordBytes || keep == 0 {
+				break
+			}
+			keep -= len(message) - s.maxRecordBytes
+		}
+		// the envelope alone can be over the limit
+		if len(message) > s.maxRecordBytes {
+			s.dropped++
+			return
+		}
+	}
+	if s.maxBytes > 0 && s.pendingBytes+len(message) > s.maxBytes {
+		s.dropped++
+		return
+	}
+
+	s.pending = append(s.pending, message)
+	s.pendingBytes += len(message)
+}
+
+// Flush writes the queued letters and logs how many were dropped by the limits since the last flush
+func (s *Sink) Flush() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dropped > 0 {
+		log.Warn().Printf("Dropped %d dead letters over the configured limits\n", s.dropped)
+		s.dropped = 0
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+	_, _, err := s.flusher.FlushRaw(s.pending)
+	s.pending = nil
+	s.pendingBytes = 0
+	if err != nil {
+		return fmt.Errorf("error flushing dead letters: %w", err)
+	}
+	return nil
+}
+
+// Close writes the queued letters and closes the destination
+func (s *Sink) Close() error {
+	if s == nil {
+		return nil
+	}
+	err := s.Flush()
+	if closeErr := s.flusher.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("error closing dead letters: %w", closeErr)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingFlusher struct {
+	messages [][]byte
+}
+
+func (f *recordingFlusher) Close() error {
+	return nil
+}
+
+func (f *recordingFlusher) FlushRaw(messages [][]byte) (int, int, error) {
+	f.messages = append(f.messages, messages...)
+	return 0, len(messages), nil
+}
+
+func TestSink(t *testing.T) {
+	flusher := &recordingFlusher{}
+	sink := newSink(flusher, 0, 0, 0)
+
+	record := map[interface{}]interface{}{
+		"log":    []byte("not emf"),
+		"nested": map[interface{}]interface{}{"values": []interface{}{int64(1), []byte("two")}},
+	}
+	sink.Send("no aws metadata", "app.web", time.UnixMilli(1700000000123), record)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(flusher.messages) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(flusher.messages))
+	}
+	expected := `{"reason":"no aws metadata","tag":"app.web","timestamp":1700000000123,"record":{"log":"not emf","nested":{"values":[1,"two"]}}}`
+	if string(flusher.messages[0]) != expected {
+		t.Errorf("Expected %s, got %s", expected, flusher.messages[0])
+	}
+
+	// nothing new to write
+	if err := sink.Flush(); err != nil || len(flusher.messages) != 1 {
+		t.Errorf("Expected nothing more to be written, got %d (%v)", len(flusher.messages), err)
+	}
+}
+
+func TestSinkUndecodedEvent(t *testing.T) {
+	flusher := &recordingFlusher{}
+	sink := newSink(flusher, 0, 0, 0)
+
+	sink.Send("invalid event", "app.web", time.UnixMilli(1700000000123), []interface{}{int64(1700000000), []byte("oops")})
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := `{"reason":"invalid event","tag":"app.web","timestamp":1700000000123,"record":[1700000000,"oops"]}`
+	if len(flusher.messages) != 1 || string(flusher.messages[0]) != expected {
+		t.Errorf("Expected %s, got %s", expected, flusher.messages)
+	}
+}
+
+func TestSinkLimits(t *testing.T) {
+	flusher := &recordingFlusher{}
+	sink := newSink(flusher, 2, 0, 0)
+	for i := 0; i < 5; i++ {
+		sink.Send("bad", "tag", time.Now(), map[interface{}]interface{}{})
+	}
+	if sink.dropped != 3 {
+		t.Errorf("Expected 3 letters over the record limit to be dropped, got %d", sink.dropped)
+	}
+	_ = sink.Flush()
+	if len(flusher.messages) != 2 || sink.dropped != 0 {
+		t.Errorf("Expected 2 letters written and the dropped count reset, got %d and %d", len(flusher.messages), sink.dropped)
+	}
+
+	flusher = &recordingFlusher{}
+	sink = newSink(flusher, 0, 0, 100)
+	sink.Send("bad", "tag", time.Now(), map[interface{}]interface{}{"a": "b"})
+	sink.Send("bad", "tag", time.Now(), map[interface{}]interface{}{"a": "b"})
+	_ = sink.Flush()
+	if len(flusher.messages) != 1 {
+		t.Errorf("Expected the byte limit to allow 1 letter, got %d", len(flusher.messages))
+	}
+}
+
+func TestSinkTruncatesLargeRecords(t *testing.T) {
+	flusher := &recordingFlusher{}
+	sink := newSink(flusher, 0, 200, 0)
+	sink.Send("too big", "tag", time.Now(), map[interface{}]interface{}{"log": strings.Repeat(`"quoted" `, 100)})
+	_ = sink.Flush()
+
+	if len(flusher.messages) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(flusher.messages))
+	}
+	if len(flusher.messages[0]) > 200 {
+		t.Errorf("Expected the letter to be capped at 200 bytes, was %d", len(flusher.messages[0]))
+	}
+	var letter Letter
+	if err := json.Unmarshal(flusher.messages[0], &letter); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	if record, ok := letter.Record.(string); !letter.Truncated || !ok || !strings.HasPrefix(record, `{"log":"\"quoted\"`) {
+		t.Errorf("Expected a truncated record, got %+v", letter)
+	}
+}
+
+func TestSinkDropsLettersOverTinyCap(t *testing.T) {
+	flusher := &recordingFlusher{}
+	sink := newSink(flusher, 0, 20, 0)
+	sink.Send("too big", "tag", time.Now(), map[interface{}]interface{}{"log": "line"})
+	if sink.dropped != 1 {
+		t.Errorf("Expected the letter whose envelope is over the cap to be dropped, got %d dropped", sink.dropped)
+	}
+	_ = sink.Flush()
+	if len(flusher.messages) != 0 {
+		t.Errorf("Expected no letter over 20 bytes to be written, got %s", flusher.messages)
+	}
+}
+
+func TestNilSink(t *testing.T) {
+	var sink *Sink
+	sink.Send("bad", "tag", time.Now(), map[interface{}]interface{}{})
+	if err := sink.Flush(); err != nil {
+		t.Errorf("Expected a nil sink to discard letters, got %v", err)
+	}
+}
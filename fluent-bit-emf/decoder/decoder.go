@@ -0,0 +1,162 @@
+// Package decoder reads the msgpack chunks fluent-bit hands to output plugins. It understands
+// both the 1.x event layout, [timestamp, record], and the 2.x/3.x one, [[timestamp, metadata], record],
+// and skips the group start and end markers newer versions send around grouped events
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// group markers are events whose timestamp has these seconds
+	groupStart = -1
+	groupEnd   = -2
+	// msgpack extension type fluent-bit uses for its nanosecond EventTime
+	eventTimeExt = 0
+)
+
+// ErrInvalidEvent means a single event had an unexpected shape, decoding can carry on with the next one
+var ErrInvalidEvent = errors.New("invalid event")
+
+// Event is a single fluent-bit record, strings are left as []byte as fluent-bit-go does
+type Event struct {
+	Time time.Time
+	// Metadata is empty for the 1.x layout
+	Metadata map[interface{}]interface{}
+	Record   map[interface{}]interface{}
+	// Raw is the undecoded event, only set along with an ErrInvalidEvent error so the event can
+	// still be dead lettered
+	Raw interface{}
+}
+
+type Decoder struct {
+	decoder *codec.Decoder
+	length  int
+}
+
+// eventTime is fluent-bit's EventTime extension: big endian uint32 seconds then uint32 nanoseconds
+type eventTime struct {
+	seconds     int64
+	nanoseconds int64
+}
+
+func (t eventTime) WriteExt(interface{}) []byte {
+	panic("unsupported")
+}
+
+func (t eventTime) ReadExt(i interface{}, b []byte) {
+	out := i.(*eventTime)
+	if len(b) < 8 {
+		return
+	}
+	seconds := binary.BigEndian.Uint32(b)
+	// markers are written as negative seconds, which wrap around in the unsigned field
+	switch int32(seconds) {
+	case groupStart, groupEnd:
+		out.seconds = int64(int32(seconds))
+	default:
+		out.seconds = int64(seconds)
+	}
+	out.nanoseconds = int64(binary.BigEndian.Uint32(b[4:]))
+}
+
+func NewDecoder(data []byte) *Decoder {
+	handle := new(codec.MsgpackHandle)
+	handle.SetBytesExt(reflect.TypeOf(eventTime{}), eventTimeExt, &eventTime{})
+	return &Decoder{decoder: codec.NewDecoderBytes(data, handle), length: len(data)}
+}
+
+// Next returns the next event, io.EOF once the chunk is exhausted, or an ErrInvalidEvent error for
+// an event that was skipped, along with what could be read of it. Any other error means the
+// chunk itself is corrupt
+func (d *Decoder) Next() (*Event, error) {
+	for {
+		var raw interface{}
+		start := d.decoder.NumBytesRead()
+		if err := d.decoder.Decode(&raw); err != nil {
+			// running out of bytes part way through an event is corruption rather than the end
+			if errors.Is(err, io.EOF) && start >= d.length {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("failed to decode chunk: %v", err)
+		}
+
+		event, marker, err := parseEvent(raw)
+		if err != nil {
+			if event == nil {
+				event = &Event{}
+			}
+			event.Raw = raw
+			return event, err
+		}
+		if marker {
+			continue
+		}
+		return event, nil
+	}
+}
+
+// parseEvent returns true for group markers, which carry no record of their own. An event whose
+// record is invalid is still returned with its time and metadata
+func parseEvent(raw interface{}) (*Event, bool, error) {
+	entry, ok := raw.([]interface{})
+	if !ok || len(entry) != 2 {
+		return nil, false, fmt.Errorf("%w: expected a [header, record] array, was %v", ErrInvalidEvent, raw)
+	}
+
+	event := &Event{Metadata: make(map[interface{}]interface{})}
+	header := entry[0]
+	if headerArray, ok := header.([]interface{}); ok {
+		// 2.x/3.x layout, [timestamp, metadata]
+		if len(headerArray) < 2 {
+			return nil, false, fmt.Errorf("%w: expected a [timestamp, metadata] header, was %v", ErrInvalidEvent, header)
+		}
+		header = headerArray[0]
+		if metadata, ok := headerArray[1].(map[interface{}]interface{}); ok {
+			event.Metadata = metadata
+		} else if headerArray[1] != nil {
+			return nil, false, fmt.Errorf("%w: metadata was not a map, was %v", ErrInvalidEvent, headerArray[1])
+		}
+	}
+
+	seconds, nanoseconds, err := parseTime(header)
+	if err != nil {
+		return nil, false, err
+	}
+	if seconds == groupStart || seconds == groupEnd {
+		return nil, true, nil
+	}
+	event.Time = time.Unix(seconds, nanoseconds)
+
+	record, ok := entry[1].(map[interface{}]interface{})
+	if !ok {
+		return event, false, fmt.Errorf("%w: record was not a map, was %v", ErrInvalidEvent, entry[1])
+	}
+	event.Record = record
+	return event, false, nil
+}
+
+func parseTime(raw interface{}) (int64, int64, error) {
+	switch t := raw.(type) {
+	case eventTime:
+		return t.seconds, t.nanoseconds, nil
+	case *eventTime:
+		return t.seconds, t.nanoseconds, nil
+	case uint64:
+		return int64(t), 0, nil
+	case int64:
+		return t, 0, nil
+	case float64:
+		seconds := int64(t)
+		return seconds, int64((t - float64(seconds)) * 1e9), nil
+	default:
+		return 0, 0, fmt.Errorf("%w: unexpected timestamp %v (%T)", ErrInvalidEvent, raw, raw)
+	}
+}
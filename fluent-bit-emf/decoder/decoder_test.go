@@ -0,0 +1,143 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// msgpack building blocks, enough to hand write the chunks fluent-bit sends
+
+func fixarray(n int) []byte { return []byte{0x90 | byte(n)} }
+
+func fixmap(n int) []byte { return []byte{0x80 | byte(n)} }
+
+func str(s string) []byte { return append([]byte{0xa0 | byte(len(s))}, s...) }
+
+func uint32Value(v uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{0xce}, v)
+}
+
+func negativeInt(v int8) []byte { return []byte{0xd0, byte(v)} }
+
+// fixext8 with fluent-bit's EventTime type
+func eventTimeValue(seconds uint32, nanoseconds uint32) []byte {
+	b := []byte{0xd7, eventTimeExt}
+	b = binary.BigEndian.AppendUint32(b, seconds)
+	return binary.BigEndian.AppendUint32(b, nanoseconds)
+}
+
+func concat(parts ...[]byte) []byte {
+	b := make([]byte, 0)
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+func record(key string, value string) []byte {
+	return concat(fixmap(1), str(key), str(value))
+}
+
+// text reads a decoded msgpack string, which stays []byte
+func text(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return ""
+}
+
+func decodeAll(t *testing.T, chunk []byte) []*Event {
+	t.Helper()
+	d := NewDecoder(chunk)
+	events := make([]*Event, 0)
+	for {
+		event, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		events = append(events, event)
+	}
+}
+
+func TestDecodeV1(t *testing.T) {
+	chunk := concat(
+		// [EventTime, record]
+		fixarray(2), eventTimeValue(1700000000, 500), record("a", "1"),
+		// [integer seconds, record], as very old versions send
+		fixarray(2), uint32Value(1700000001), record("b", "2"),
+	)
+
+	events := decodeAll(t, chunk)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if !events[0].Time.Equal(time.Unix(1700000000, 500)) || text(events[0].Record["a"]) != "1" || len(events[0].Metadata) != 0 {
+		t.Errorf("Unexpected first event %+v", events[0])
+	}
+	if !events[1].Time.Equal(time.Unix(1700000001, 0)) || text(events[1].Record["b"]) != "2" {
+		t.Errorf("Unexpected second event %+v", events[1])
+	}
+}
+
+func TestDecodeV2(t *testing.T) {
+	chunk := concat(
+		// group start marker, [[-1, metadata], group attributes]
+		fixarray(2), fixarray(2), eventTimeValue(0xFFFFFFFF, 0), fixmap(0), record("group", "attributes"),
+		// [[EventTime, metadata], record]
+		fixarray(2), fixarray(2), eventTimeValue(1700000000, 0), record("otel", "yes"), record("a", "1"),
+		// integer marker seconds are negative ints rather than wrapped ext values
+		fixarray(2), fixarray(2), negativeInt(-2), fixmap(0), fixmap(0),
+		// metadata can be empty
+		fixarray(2), fixarray(2), eventTimeValue(1700000002, 0), fixmap(0), record("b", "2"),
+	)
+
+	events := decodeAll(t, chunk)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events with the group markers skipped, got %d", len(events))
+	}
+	if text(events[0].Metadata["otel"]) != "yes" || text(events[0].Record["a"]) != "1" || !events[0].Time.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Unexpected first event %+v", events[0])
+	}
+	if len(events[1].Metadata) != 0 || text(events[1].Record["b"]) != "2" {
+		t.Errorf("Unexpected second event %+v", events[1])
+	}
+}
+
+func TestDecodeInvalidEvent(t *testing.T) {
+	chunk := concat(
+		// record is a string rather than a map
+		fixarray(2), eventTimeValue(1700000000, 0), str("oops"),
+		fixarray(2), eventTimeValue(1700000001, 0), record("a", "1"),
+	)
+
+	d := NewDecoder(chunk)
+	event, err := d.Next()
+	if !errors.Is(err, ErrInvalidEvent) {
+		t.Fatalf("Expected %v, got %v", ErrInvalidEvent, err)
+	}
+	// returned as far as it could be read so it can be dead lettered
+	if raw, ok := event.Raw.([]interface{}); !ok || len(raw) != 2 || text(raw[1]) != "oops" || !event.Time.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Expected the raw event and its time, got %+v", event)
+	}
+	// the bad event is skipped and the rest of the chunk is still readable
+	if event, err := d.Next(); err != nil || text(event.Record["a"]) != "1" {
+		t.Errorf("Expected the next event, got %+v (%v)", event, err)
+	}
+	if _, err := d.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected %v, got %v", io.EOF, err)
+	}
+}
+
+func TestDecodeTruncatedChunk(t *testing.T) {
+	chunk := concat(fixarray(2), eventTimeValue(1700000000, 0), record("a", "1"))
+	d := NewDecoder(chunk[:len(chunk)-2])
+	if _, err := d.Next(); err == nil || errors.Is(err, ErrInvalidEvent) || errors.Is(err, io.EOF) {
+		t.Errorf("Expected a chunk error, got %v", err)
+	}
+}
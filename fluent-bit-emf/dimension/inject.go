@@ -0,0 +1,149 @@
+package dimension
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// Injection sources
+const (
+	SourceValue    = "value"
+	SourceEnv      = "env"
+	SourceHostname = "hostname"
+	SourceField    = "field"
+	SourceMetadata = "metadata"
+)
+
+// Injection placements
+const (
+	// PlacementAppend adds the dimension to every dimension set, or to the sets with Target in them when it's set
+	PlacementAppend = "append"
+	// PlacementSet adds the dimension as a new set of its own, keeping the existing ones
+	PlacementSet = "set"
+)
+
+// Injection adds a dimension the application doesn't know about to every record
+type Injection struct {
+	Name   string
+	Source string
+	// Value of the static sources, resolved once when parsed
+	Value string
+	// Field is the path to a field of the fluent-bit record or its metadata, e.x. kubernetes.namespace_name
+	Field     []string
+	Placement string
+	Target    string
+}
+
+// Injections are applied in order
+type Injections []Injection
+
+// Resolve returns the value to inject for the fluent-bit record and its metadata, false when it
+// has no such field
+func (i Injection) Resolve(record map[interface{}]interface{}, metadata map[interface{}]interface{}) (string, bool) {
+	var value interface{}
+	switch i.Source {
+	case SourceField:
+		value = record
+	case SourceMetadata:
+		value = metadata
+	default:
+		return i.Value, true
+	}
+	for _, key := range i.Field {
+		fields, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = lookup(fields, key); !ok {
+			return "", false
+		}
+	}
+	if value == nil {
+		return "", false
+	}
+	resolved := utils.ToString(value)
+	return resolved, resolved != ""
+}
+
+// lookup finds a key in decoded msgpack, which can be a string or []byte
+func lookup(fields map[interface{}]interface{}, key string) (interface{}, bool) {
+	if value, exists := fields[key]; exists {
+		return value, true
+	}
+	for k, value := range fields {
+		if utils.ToString(k) == key {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// ParseInjections parses injections of the form `<name> <source>[:param] [placement[:target]]`
+// separated by `;`, e.g.
+//
+//	Cluster value:prod; Host hostname; AZ env:AWS_AZ set; Namespace field:kubernetes.namespace_name append:Service
+//
+// value takes the dimension value, env an environment variable, field a `.` separated path
+// into the fluent-bit record and metadata one into its fluent-bit 2.x+ metadata. Records without
+// the field aren't given the dimension. The
+// dimension is appended to every set by default, `append:<dimension>` only appends it to sets
+// with that dimension and `set` adds it as a set of its own
+func ParseInjections(value string) (Injections, error) {
+	injections := make(Injections, 0)
+	for _, raw := range strings.Split(value, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		fields := strings.Fields(raw)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("dimension injection %q should be `<name> <source> [placement]`", raw)
+		}
+
+		injection := Injection{Name: fields[0], Placement: PlacementAppend}
+		source, param, _ := strings.Cut(fields[1], ":")
+		injection.Source = strings.ToLower(source)
+		switch injection.Source {
+		case SourceValue:
+			if param == "" {
+				return nil, fmt.Errorf("dimension injection %q: value needs a value", raw)
+			}
+			injection.Value = param
+		case SourceEnv:
+			value, exists := os.LookupEnv(param)
+			if param == "" || !exists || value == "" {
+				return nil, fmt.Errorf("dimension injection %q: environment variable %q isn't set", raw, param)
+			}
+			injection.Value = value
+		case SourceHostname:
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("dimension injection %q: %w", raw, err)
+			}
+			injection.Value = hostname
+		case SourceField, SourceMetadata:
+			if param == "" {
+				return nil, fmt.Errorf("dimension injection %q: %s needs a path", raw, injection.Source)
+			}
+			injection.Field = strings.Split(param, ".")
+		default:
+			return nil, fmt.Errorf("dimension injection %q has unknown source %q, expected value, env, hostname, field or metadata", raw, source)
+		}
+
+		if len(fields) == 3 {
+			placement, target, _ := strings.Cut(fields[2], ":")
+			injection.Placement, injection.Target = strings.ToLower(placement), target
+			switch {
+			case injection.Placement == PlacementAppend:
+			case injection.Placement == PlacementSet && target == "":
+			default:
+				return nil, fmt.Errorf("dimension injection %q has unknown placement %q, expected append, append:<dimension> or set", raw, fields[2])
+			}
+		}
+		injections = append(injections, injection)
+	}
+	return injections, nil
+}
@@ -0,0 +1,72 @@
+package dimension
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseInjections(t *testing.T) {
+	t.Setenv("TEST_AZ", "us-east-1a")
+	hostname, _ := os.Hostname()
+
+	injections, err := ParseInjections("Cluster value:prod; Host HOSTNAME; AZ env:TEST_AZ set; Namespace field:kubernetes.namespace_name append:Service; Service metadata:otel.service;")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(injections) != 5 {
+		t.Fatalf("Expected 5 injections, got %+v", injections)
+	}
+
+	record := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{"namespace_name": []byte("payments")},
+	}
+	metadata := map[interface{}]interface{}{
+		"otel": map[interface{}]interface{}{"service": []byte("checkout")},
+	}
+	for i, expected := range []struct {
+		value     string
+		placement string
+		target    string
+	}{
+		{value: "prod", placement: PlacementAppend},
+		{value: hostname, placement: PlacementAppend},
+		{value: "us-east-1a", placement: PlacementSet},
+		{value: "payments", placement: PlacementAppend, target: "Service"},
+		{value: "checkout", placement: PlacementAppend},
+	} {
+		injection := injections[i]
+		value, ok := injection.Resolve(record, metadata)
+		if !ok || value != expected.value || injection.Placement != expected.placement || injection.Target != expected.target {
+			t.Errorf("%s: expected %+v, got %q %v %+v", injection.Name, expected, value, ok, injection)
+		}
+	}
+
+	for _, missing := range []map[interface{}]interface{}{
+		{},
+		{"kubernetes": "not a map"},
+		{"kubernetes": map[interface{}]interface{}{"namespace_name": ""}},
+	} {
+		if value, ok := injections[3].Resolve(missing, nil); ok {
+			t.Errorf("Expected no value for %v, got %q", missing, value)
+		}
+		if value, ok := injections[4].Resolve(record, missing); ok {
+			t.Errorf("Expected no metadata value for %v, got %q", missing, value)
+		}
+	}
+
+	for _, invalid := range []string{
+		"Cluster",
+		"Cluster value:",
+		"Cluster env:TEST_UNSET_VARIABLE",
+		"Cluster field:",
+		"Cluster metadata:",
+		"Cluster unknown:x",
+		"Cluster value:prod set:Service",
+		"Cluster value:prod prepend",
+		"Cluster value:prod set extra",
+	} {
+		if _, err := ParseInjections(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
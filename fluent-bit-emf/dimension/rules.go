@@ -0,0 +1,140 @@
+// Package dimension rewrites and injects dimensions before records are aggregated, so values
+// that differ only by ids or case end up in the same series and records carry the dimensions of
+// where they came from
+package dimension
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// Rule actions
+const (
+	ActionReplace  = "replace"
+	ActionLower    = "lower"
+	ActionUpper    = "upper"
+	ActionAllow    = "allow"
+	ActionTruncate = "truncate"
+)
+
+// DefaultBucket replaces values missing from an allow list that doesn't name its own default
+const DefaultBucket = "other"
+
+// Rule rewrites the values of dimensions whose name matches its glob
+type Rule struct {
+	Dimension string
+	Action    string
+	// Pattern and Replacement are the regexp.ReplaceAllString arguments of replace
+	Pattern     *regexp.Regexp
+	Replacement string
+	// Allowed values of allow, anything else becomes Default
+	Allowed map[string]bool
+	Default string
+	// Length is the most bytes truncate keeps
+	Length int
+}
+
+// Rules are all applied in order, each to the value left by the rules before it
+type Rules []Rule
+
+// Apply returns the value of the dimension after every matching rule
+func (rules Rules) Apply(name string, value string) string {
+	for _, rule := range rules {
+		if !utils.GlobMatch(rule.Dimension, name) {
+			continue
+		}
+		switch rule.Action {
+		case ActionReplace:
+			value = rule.Pattern.ReplaceAllString(value, rule.Replacement)
+		case ActionLower:
+			value = strings.ToLower(value)
+		case ActionUpper:
+			value = strings.ToUpper(value)
+		case ActionAllow:
+			if !rule.Allowed[value] {
+				value = rule.Default
+			}
+		case ActionTruncate:
+			if len(value) > rule.Length {
+				// without splitting a UTF-8 character
+				n := rule.Length
+				for n > 0 && value[n]&0xC0 == 0x80 {
+					n--
+				}
+				value = value[:n]
+			}
+		}
+	}
+	return value
+}
+
+// ParseRules parses rules of the form `<dimension glob> <action> [params]` separated by `;`, e.g.
+//
+//	Path replace /[0-9]+ /{id}; Method upper; Status allow 200,404,500 other; * truncate 128
+//
+// replace takes a regular expression and a replacement that can refer to its groups as $1,
+// neither can contain spaces or `;`. allow takes the allowed values and optionally the value
+// anything else becomes, DefaultBucket when it's left out, and truncate takes a length in bytes
+func ParseRules(value string) (Rules, error) {
+	rules := make(Rules, 0)
+	for _, raw := range strings.Split(value, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		fields := strings.Fields(raw)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("dimension rule %q should be `<dimension> <action> [params]`", raw)
+		}
+
+		rule := Rule{Dimension: fields[0], Action: strings.ToLower(fields[1])}
+		params := fields[2:]
+		switch rule.Action {
+		case ActionReplace:
+			if len(params) < 1 || len(params) > 2 {
+				return nil, fmt.Errorf("dimension rule %q: replace takes a pattern and an optional replacement", raw)
+			}
+			pattern, err := regexp.Compile(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("dimension rule %q has an invalid pattern: %w", raw, err)
+			}
+			rule.Pattern = pattern
+			if len(params) == 2 {
+				rule.Replacement = params[1]
+			}
+		case ActionLower, ActionUpper:
+			if len(params) != 0 {
+				return nil, fmt.Errorf("dimension rule %q: %s takes no parameters", raw, rule.Action)
+			}
+		case ActionAllow:
+			if len(params) < 1 || len(params) > 2 {
+				return nil, fmt.Errorf("dimension rule %q: allow takes a comma separated list and an optional default", raw)
+			}
+			rule.Allowed = make(map[string]bool)
+			for _, allowed := range strings.Split(params[0], ",") {
+				rule.Allowed[allowed] = true
+			}
+			rule.Default = DefaultBucket
+			if len(params) == 2 {
+				rule.Default = params[1]
+			}
+		case ActionTruncate:
+			if len(params) != 1 {
+				return nil, fmt.Errorf("dimension rule %q: truncate takes a length", raw)
+			}
+			length, err := strconv.Atoi(params[0])
+			if err != nil || length < 1 {
+				return nil, fmt.Errorf("dimension rule %q has an invalid length %q, expected a positive integer", raw, params[0])
+			}
+			rule.Length = length
+		default:
+			return nil, fmt.Errorf("dimension rule %q has unknown action %q, expected replace, lower, upper, allow or truncate", raw, rule.Action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
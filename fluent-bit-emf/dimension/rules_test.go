@@ -0,0 +1,60 @@
+package dimension
+
+import "testing"
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("Path replace /[0-9]+ /{id}; Method UPPER; Status allow 200,404 error ;Region allow us-east-1;* truncate 8;")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rules) != 5 {
+		t.Fatalf("Expected 5 rules, got %+v", rules)
+	}
+
+	for _, tc := range []struct {
+		name, value, expected string
+	}{
+		{name: "Path", value: "/users/123/orders/45", expected: "/users/{"},
+		{name: "Path", value: "/a/1", expected: "/a/{id}"},
+		{name: "Method", value: "get", expected: "GET"},
+		{name: "Status", value: "404", expected: "404"},
+		{name: "Status", value: "503", expected: "error"},
+		{name: "Region", value: "eu-west-1", expected: DefaultBucket},
+		{name: "Other", value: "héééé", expected: "hééé"},
+		{name: "Other", value: "short", expected: "short"},
+	} {
+		if value := rules.Apply(tc.name, tc.value); value != tc.expected {
+			t.Errorf("%s=%s: expected %q, got %q", tc.name, tc.value, tc.expected, value)
+		}
+	}
+
+	for _, invalid := range []string{
+		"Path",
+		"Path unknown",
+		"Path replace",
+		"Path replace ( x",
+		"Path replace a b c",
+		"Path lower x",
+		"Path allow",
+		"Path truncate",
+		"Path truncate 0",
+		"Path truncate x",
+	} {
+		if _, err := ParseRules(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestApply_ReplaceGroups(t *testing.T) {
+	rules, err := ParseRules(`Path replace ^/([a-z]+)/[^/]+$ /$1/{id}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if value := rules.Apply("Path", "/users/abc-123"); value != "/users/{id}" {
+		t.Errorf("Expected the group to be kept, got %q", value)
+	}
+	if value := Rules(nil).Apply("Path", "/users/abc-123"); value != "/users/abc-123" {
+		t.Errorf("Expected no rules to leave the value, got %q", value)
+	}
+}
@@ -7,50 +7,86 @@ package emf
 */
 import (
 	"C"
+	"errors"
 	"fmt"
-	"sort"
-	"strings"
+	"io"
 	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/deadletter"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/decoder"
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/histogram"
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/log"
-	"github.com/fluent/fluent-bit-go/output"
 )
 import "github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/flush"
 
 type InputStats struct {
-	InputLength  int
-	InputRecords int
+	InputLength       int
+	InputRecords      int
+	ClampedTimestamps int
+	UnitConflicts     UnitConflictStats
+	Cardinality       CardinalityStats
+}
+
+// UnitConflictStats counts the values seen in a different unit than their series, by how they were resolved
+type UnitConflictStats struct {
+	Converted int
+	Split     int
+	Rejected  int
 }
 
 // Plugin context
 type EMFAggregator struct {
 	mu                sync.RWMutex
 	aggregationPeriod time.Duration
-	// Map of dimension hash -> metric name -> aggregated values
+	histogramOptions  histogram.Options
+	histogramRules    histogram.Rules
+	options           *common.PluginOptions
+	// tagRouted is set when destinations depend on the tag
+	tagRouted   bool
+	diagnostics *diagnosticLog
+	seriesKeys  *seriesKeys
+	cardinality *cardinalityLimiter
+	// Map of series key -> metric name -> aggregated values
 	metrics map[string]map[string]*histogram.Histogram
 	// Store metadata and metric definitions
 	metadataStore map[string]Metadata
 	stats         InputStats
 
 	// flushing helpers
-	flusher flush.Flusher
-	Task    *ScheduledTask
+	flusher    flush.Flusher
+	deadLetter *deadletter.Sink
+	Task       *ScheduledTask
 }
 
 type Metadata struct {
 	AWS        *common.AWSMetadata
 	Dimensions map[string]string
+	Tag        string
+	// Units is the first unit the series saw each metric in, by name, empty when it had none. It's
+	// published in the canonical unit of its quantity when converting
+	Units map[string]string
+	// Properties are the retained properties written with the series
+	Properties *retainedProperties
 }
 
 func NewEMFAggregator(options *common.PluginOptions) (*EMFAggregator, error) {
 	aggregator := &EMFAggregator{
 		aggregationPeriod: options.AggregationPeriod,
-		metrics:           make(map[string]map[string]*histogram.Histogram),
-		metadataStore:     make(map[string]Metadata),
+		histogramOptions: histogram.Options{
+			BucketMeans:       options.BucketMeans,
+			SignificantDigits: options.SignificantDigits,
+		},
+		histogramRules: options.HistogramRules,
+		options:        options,
+		tagRouted:      flush.UsesTagPlaceholder(options),
+		diagnostics:    newDiagnosticLog(options.DiagnosticSampleRate),
+		seriesKeys:     newSeriesKeys(),
+		cardinality:    newCardinalityLimiter(options),
+		metrics:        make(map[string]map[string]*histogram.Histogram),
+		metadataStore:  make(map[string]Metadata),
 	}
 
 	var err error
@@ -59,31 +95,57 @@ func NewEMFAggregator(options *common.PluginOptions) (*EMFAggregator, error) {
 		return nil, err
 	}
 
+	if aggregator.deadLetter, err = deadletter.NewSink(options); err != nil {
+		return nil, err
+	}
+
 	aggregator.Task = NewScheduledTask(options.AggregationPeriod, aggregator.flush)
 
 	return aggregator, nil
 }
 
 // this is a helper function of sets to ensure we are locking appropriately
-func (a *EMFAggregator) Aggregate(data unsafe.Pointer, length int) {
-	dec := output.NewDecoder(data, length)
+// tag is the fluent-bit tag of the chunk
+func (a *EMFAggregator) Aggregate(data unsafe.Pointer, length int, tag string) {
+	dec := decoder.NewDecoder(C.GoBytes(data, C.int(length)))
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	for {
-		ret, _, record := output.GetRecord(dec)
-		if ret != 0 {
+	for index := 0; ; index++ {
+		event, err := dec.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, decoder.ErrInvalidEvent) {
+			log.Error().Printf("skipping fluent-bit event: %v\n", err)
+			eventTime := event.Time
+			if eventTime.IsZero() {
+				eventTime = time.Now()
+			}
+			a.deadLetter.Send(err.Error(), tag, eventTime, event.Raw)
+			continue
+		}
+		if err != nil {
+			log.Error().Printf("dropping rest of chunk: %v\n", err)
 			break
 		}
 
 		// Create EMF metric directly from record
-		emf, err := EmfFromRecord(record)
+		emf, err := EmfFromRecord(event.Record, event.Metadata, event.Time, tag, a.options)
 
 		if err != nil {
 			log.Error().Printf("failed to process EMF record: %v\n", err)
+			a.deadLetter.Send(err.Error(), tag, event.Time, event.Record)
 			continue
 		}
+		for _, diagnostic := range emf.Diagnostics {
+			diagnostic.Record = index
+			a.diagnostics.record(diagnostic)
+		}
+		if emf.TimestampClamped {
+			a.stats.ClampedTimestamps++
+		}
 
 		// Aggregate the metric
 		a.AggregateMetric(emf)
@@ -94,23 +156,69 @@ func (a *EMFAggregator) Aggregate(data unsafe.Pointer, length int) {
 }
 
 func (a *EMFAggregator) AggregateMetric(emf *EMFMetric) {
-	// Create dimension hash for grouping
-	dimHash := createDimensionHash(emf.Dimensions)
+	if len(emf.AWS.CloudWatchMetrics) == 0 {
+		// every metric was dropped by the metric rules
+		return
+	}
+	if a.options.DecomposeDimensionSets {
+		for _, part := range emf.Decompose() {
+			a.aggregateSeries(part)
+		}
+		return
+	}
+	a.aggregateSeries(emf)
+}
+
+func (a *EMFAggregator) aggregateSeries(emf *EMFMetric) {
+	// Key the series by its directives and dimensions, routed tags always need their own series
+	key := a.seriesKeys.build(emf, a.options.TagSeriesKey || a.tagRouted)
 
-	// Initialize or update metadata store
-	if metadata, exists := a.metadataStore[dimHash]; !exists {
-		a.metadataStore[dimHash] = Metadata{
-			AWS:        emf.AWS,
-			Dimensions: emf.Dimensions,
+	// Initialize or update metadata store, the key is only copied for a new series
+	metadata, exists := a.metadataStore[string(key)]
+
+	// metrics over their own limit, folded or dropped once the rest of the record is aggregated
+	var overflow func()
+	if !emf.Overflow {
+		if !exists {
+			if limit := a.cardinality.exceeded(emf); limit != "" {
+				a.overLimit(limit, []string{string(key)}, emf)
+				return
+			}
 		}
-	} else {
-		// Store AWS metadata
-		if metadata.AWS == nil {
-			metadata.AWS = emf.AWS
-		} else {
-			metadata.AWS.Merge(emf.AWS)
+		seriesMetrics := a.metrics[string(key)]
+		over, limit := a.cardinality.metricsExceeded(emf, func(name string) bool {
+			_, exists := seriesMetrics[name]
+			return !exists
+		})
+		if len(over) > 0 {
+			series := make([]string, len(over))
+			for i, name := range over {
+				series[i] = string(key) + name
+			}
+			if len(over) == len(emf.MetricData) {
+				a.overLimit(limit, series, emf)
+				return
+			}
+			part := emf.withMetrics(over, true)
+			overflow = func() { a.overLimit(limit, series, part) }
+			emf = emf.withMetrics(over, false)
 		}
+	}
 
+	if !exists {
+		a.cardinality.add(emf)
+
+		metadata = Metadata{
+			// the directives are merged in once the units are resolved, into an empty copy so
+			// they're canonical and never shared with the record
+			AWS:        &common.AWSMetadata{},
+			Dimensions: a.seriesKeys.internDimensions(emf.Dimensions),
+			Tag:        emf.Tag,
+			Units:      make(map[string]string, len(emf.MetricData)),
+			Properties: newRetainedProperties(),
+		}
+		a.metadataStore[a.seriesKeys.internBytes(key)] = metadata
+	} else {
 		// Store extra fields
 		for key, value := range emf.Dimensions {
 			// Only update if the field doesn't exist or is empty
@@ -120,34 +228,147 @@ func (a *EMFAggregator) AggregateMetric(emf *EMFMetric) {
 		}
 	}
 
-	// Initialize metric map for this dimension set if not exists
-	if _, exists := a.metrics[dimHash]; !exists {
-		a.metrics[dimHash] = make(map[string]*histogram.Histogram)
+	metadata.Properties.add(emf, a.options.RetainedProperties)
+
+	// Initialize metric map for this series if not exists
+	metrics, exists := a.metrics[string(key)]
+	if !exists {
+		metrics = make(map[string]*histogram.Histogram)
+		a.metrics[a.seriesKeys.internBytes(key)] = metrics
 	}
 
+	converting := a.options.UnitConflicts == common.UnitConflictsConvert
+	// metrics in a different unit than the series saw them in before, by unit
+	var split map[string][]string
+	// metrics rejected or split off, their declarations aren't merged into the series
+	var excluded []string
+
 	// Aggregate each metric
 	for name, value := range emf.MetricData {
-		if _, exists := a.metrics[dimHash][name]; !exists {
-			a.metrics[dimHash][name] = histogram.NewHistogram()
+		unit := emf.UnitOf(name)
+		if seriesUnit, known := metadata.Units[name]; !known {
+			metadata.Units[name] = unit
+		} else if unit != seriesUnit {
+			// values without a unit could be in any, so they conflict with values in one too
+			_, convertible := conversionFactor(unit, seriesUnit)
+			switch {
+			case a.options.UnitConflicts == common.UnitConflictsReject:
+				log.Debug().Printf("Rejecting %s in %q, the series has it in %q\n", name, unit, seriesUnit)
+				a.stats.UnitConflicts.Rejected++
+				excluded = append(excluded, name)
+				continue
+			case converting && convertible:
+				a.stats.UnitConflicts.Converted++
+			default:
+				if split == nil {
+					split = make(map[string][]string)
+				}
+				// units of a quantity share the series split off in its canonical unit
+				if canonical, _, convertible := canonicalUnit(unit); converting && convertible {
+					unit = canonical
+				}
+				split[unit] = append(split[unit], name)
+				a.stats.UnitConflicts.Split++
+				excluded = append(excluded, name)
+				continue
+			}
 		}
 
-		metric := a.metrics[dimHash][name]
+		if converting {
+			// both sides of a conflict end up in the same unit rather than the first one seen
+			if _, factor, convertible := canonicalUnit(unit); convertible {
+				value = value.scaled(factor)
+			}
+		}
 
+		if _, exists := metrics[name]; !exists {
+			options := a.histogramRules.Options(emf.NamespaceOf(name), name, a.histogramOptions)
+			metrics[name] = histogram.NewHistogram(options)
+		}
+
+		metric := metrics[name]
+
+		var err error
 		if value.Value != nil {
-			metric.Add(*value.Value, 1)
+			err = metric.Add(*value.Value, 1)
 		} else if value.Values == nil {
-			if value.Max != nil && value.Min == value.Max {
-				metric.Add(*value.Max, *value.Count)
+			if value.Min != nil && value.Max != nil && value.Sum != nil && value.Count != nil {
+				// statistic set from another aggregator
+				err = metric.AddStatisticSet(*value.Min, *value.Max, *value.Sum, *value.Count)
 			} else {
 				log.Warn().Printf("Invalid metric value found for metric %s: %v\n", name, value)
 				continue
 			}
+		} else if value.Counts != nil && len(value.Counts) != len(value.Values) {
+			log.Warn().Printf("Invalid metric value found for metric %s: %d Values but %d Counts\n", name, len(value.Values), len(value.Counts))
+			continue
+		} else if value.Min != nil && value.Max != nil && value.Sum != nil {
+			// already aggregated upstream, keep its exact statistics
+			counts := value.Counts
+			if counts == nil {
+				counts = onesFor(value.Values)
+			}
+			err = metric.AddDistribution(value.Values, counts, *value.Min, *value.Max, *value.Sum)
 		} else {
 			for index, v := range value.Values {
-				metric.Add(v, value.Counts[index])
+				count := uint64(1)
+				if value.Counts != nil {
+					count = value.Counts[index]
+				}
+				if err = metric.Add(v, count); err != nil {
+					break
+				}
 			}
 		}
+		if err != nil {
+			log.Warn().Printf("Dropping value for metric %s: %v\n", name, err)
+		}
+	}
+
+	// Merge the directives, which may declare metrics earlier records of the series didn't
+	metadata.AWS.Merge(emf.seriesDirectives(metadata.Units, excluded, converting))
+
+	for unit, names := range split {
+		a.aggregateSeries(emf.splitUnit(unit, names))
+	}
+	if overflow != nil {
+		overflow()
+	}
+}
+
+// overLimit folds or drops a record over a cardinality limit, series are what it's counted as,
+// each only once per period
+func (a *EMFAggregator) overLimit(limit string, series []string, emf *EMFMetric) {
+	first := 0
+	for _, s := range series {
+		if a.cardinality.firstOverflow(s) {
+			first++
+		}
+	}
+	if a.options.CardinalityOverflow == common.CardinalityOverflowDrop {
+		a.cardinality.warn(limit, emf, "dropped")
+		a.stats.Cardinality.Dropped += first
+		return
 	}
+	a.cardinality.warn(limit, emf, "folded into the "+OverflowValue+" series")
+	a.stats.Cardinality.Folded += first
+	a.aggregateSeries(emf.overflow())
+}
+
+// Close stops the periodic flush, writes what's left and closes every destination
+func (a *EMFAggregator) Close() error {
+	a.Task.Stop()
+	err := a.flush()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if closeErr := a.flusher.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := a.deadLetter.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func (a *EMFAggregator) flush() error {
@@ -155,6 +376,10 @@ func (a *EMFAggregator) flush() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	if err := a.deadLetter.Flush(); err != nil {
+		log.Error().Printf("%v\n", err)
+	}
+
 	if len(a.metrics) == 0 {
 		log.Info().Println("No metrics to flush, skipping")
 		return nil
@@ -162,17 +387,17 @@ func (a *EMFAggregator) flush() error {
 
 	outputEvents := make([]common.EMFEvent, 0, len(a.metrics))
 
-	for dimHash, metricMap := range a.metrics {
+	for key, metricMap := range a.metrics {
 		// Get the metadata for this dimension set
-		metadata, exists := a.metadataStore[dimHash]
+		metadata, exists := a.metadataStore[key]
 		if !exists {
-			log.Warn().Printf("No metadata found for dimension hash %s\n", dimHash)
+			log.Warn().Printf("No metadata found for series %q\n", key)
 			continue
 		}
 
 		// Skip if no AWS metadata is available
 		if metadata.AWS == nil {
-			log.Warn().Printf("No AWS metadata found for dimension hash %s\n", dimHash)
+			log.Warn().Printf("No AWS metadata found for series %q\n", key)
 			continue
 		}
 
@@ -180,6 +405,7 @@ func (a *EMFAggregator) flush() error {
 		outputMap := common.EMFEvent{
 			AWS:         metadata.AWS,
 			OtherFields: make(map[string]interface{}),
+			Tag:         metadata.Tag,
 		}
 
 		// Add all metric values
@@ -189,7 +415,7 @@ func (a *EMFAggregator) flush() error {
 				log.Warn().Printf("No stats found for metric %s\n", name)
 				continue
 			}
-			if len(stats.Values) == 1 {
+			if len(stats.Values) == 1 && stats.Counts[0] == 1 && stats.Min == stats.Max {
 				// Single value
 				outputMap.OtherFields[name] = stats.Max
 			} else {
@@ -200,6 +426,7 @@ func (a *EMFAggregator) flush() error {
 		for key, value := range metadata.Dimensions {
 			outputMap.OtherFields[key] = value
 		}
+		metadata.Properties.fields(outputMap.OtherFields)
 
 		outputEvents = append(outputEvents, outputMap)
 	}
@@ -218,31 +445,31 @@ func (a *EMFAggregator) flush() error {
 	size_percentage := int(float64(a.stats.InputLength-size) / float64(a.stats.InputLength) * 100)
 	count_percentage := int(float64(a.stats.InputRecords-count) / float64(a.stats.InputRecords) * 100)
 
+	if summary := a.diagnostics.summary(); summary != "" {
+		log.Warn().Printf("Dropped invalid parts of EMF records: %s\n", summary)
+	}
+	if a.stats.ClampedTimestamps > 0 {
+		log.Warn().Printf("Clamped %d timestamps outside the accepted window\n", a.stats.ClampedTimestamps)
+	}
+	if cardinality := a.stats.Cardinality; cardinality != (CardinalityStats{}) {
+		log.Warn().Printf("New series over the cardinality limits: %d folded, %d dropped\n", cardinality.Folded, cardinality.Dropped)
+	}
+	if conflicts := a.stats.UnitConflicts; conflicts != (UnitConflictStats{}) {
+		log.Warn().Printf("Resolved unit conflicts: %d converted, %d split, %d rejected\n", conflicts.Converted, conflicts.Split, conflicts.Rejected)
+	}
 	log.Info().Printf("Compressed %d bytes into %d bytes or %d%%; and %d Records into %d or %d%%\n", a.stats.InputLength, size, size_percentage, a.stats.InputRecords, count, count_percentage)
 
 	// Reset metrics after successful flush
 	a.metrics = make(map[string]map[string]*histogram.Histogram)
 	a.metadataStore = make(map[string]Metadata)
+	a.seriesKeys.reset()
+	a.cardinality.reset()
 	a.stats.InputLength = 0
 	a.stats.InputRecords = 0
+	a.stats.ClampedTimestamps = 0
+	a.stats.UnitConflicts = UnitConflictStats{}
+	a.stats.Cardinality = CardinalityStats{}
 
 	log.Info().Println("Completed Flushing")
 	return nil
 }
-
-// Helper functions
-func createDimensionHash(dimensions map[string]string) string {
-	// Create a slice to hold the sorted key-value pairs
-	pairs := make([]string, 0, len(dimensions))
-
-	// Convert map entries to sorted slice
-	for k, v := range dimensions {
-		pairs = append(pairs, k+"="+v)
-	}
-
-	// Sort the pairs to ensure consistent ordering
-	sort.Strings(pairs)
-
-	// Join all pairs with a delimiter
-	return strings.Join(pairs, ";")
-}
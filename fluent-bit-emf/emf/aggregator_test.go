@@ -0,0 +1,147 @@
+package emf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/histogram"
+)
+
+func newTestAggregator(options *common.PluginOptions) *EMFAggregator {
+	return &EMFAggregator{
+		options:       options,
+		metrics:       make(map[string]map[string]*histogram.Histogram),
+		metadataStore: make(map[string]Metadata),
+		seriesKeys:    newSeriesKeys(),
+		cardinality:   newCardinalityLimiter(options),
+	}
+}
+
+// rollupKey is the series key of the [Service] rollup part of a rollupRecord
+func rollupKey(t *testing.T, options *common.PluginOptions) string {
+	emf, err := EmfFromRecord(rollupRecord("Get", 0), nil, time.Now(), "", options)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, part := range emf.Decompose() {
+		if len(part.Dimensions) == 1 {
+			return string(newSeriesKeys().build(part, false))
+		}
+	}
+	t.Fatalf("Expected a Service rollup part")
+	return ""
+}
+
+func rollupRecord(operation string, latency float64) map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"_aws": map[interface{}]interface{}{
+			"Timestamp": int64(1700000000000),
+			"CloudWatchMetrics": []interface{}{
+				map[interface{}]interface{}{
+					"Namespace":  "TestNamespace",
+					"Dimensions": []interface{}{[]interface{}{"Service"}, []interface{}{"Service", "Operation"}},
+					"Metrics":    []interface{}{map[interface{}]interface{}{"Name": "Latency"}},
+				},
+			},
+		},
+		"Service":   "api",
+		"Operation": operation,
+		"Latency":   latency,
+	}
+}
+
+func TestAggregateMetric_DecomposeDimensionSets(t *testing.T) {
+	for _, tc := range []struct {
+		decompose bool
+		series    int
+	}{
+		{decompose: false, series: 3},
+		{decompose: true, series: 4},
+	} {
+		options := &common.PluginOptions{DecomposeDimensionSets: tc.decompose}
+		a := newTestAggregator(options)
+		for i, operation := range []string{"Get", "Put", "List", "Get"} {
+			emf, err := EmfFromRecord(rollupRecord(operation, float64(i)), nil, time.Now(), "", options)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			a.AggregateMetric(emf)
+		}
+
+		if len(a.metrics) != tc.series {
+			t.Errorf("decompose %v: expected %d series, got %d", tc.decompose, tc.series, len(a.metrics))
+		}
+		if !tc.decompose {
+			continue
+		}
+
+		// the [Service] rollup holds every value, once
+		key := rollupKey(t, options)
+		rollup := a.metrics[key]
+		if rollup == nil {
+			t.Fatalf("Expected a Service rollup series, got %v", a.metrics)
+		}
+		if stats := rollup["Latency"].Reduce(); stats.Sum != 6 || stats.Max != 3 {
+			t.Errorf("Expected the rollup to aggregate every operation, got %+v", stats)
+		}
+		metadata := a.metadataStore[key]
+		if len(metadata.Dimensions) != 1 || len(metadata.AWS.CloudWatchMetrics) != 1 || len(metadata.AWS.CloudWatchMetrics[0].Dimensions) != 1 {
+			t.Errorf("Expected the rollup to only carry its own dimension set, got %+v", metadata)
+		}
+	}
+}
+
+func TestDecompose(t *testing.T) {
+	emf, err := EmfFromRecord(rollupRecord("Get", 1), nil, time.Now(), "", &common.PluginOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	emf.AWS.CloudWatchMetrics = append(emf.AWS.CloudWatchMetrics, common.ProjectionDefinition{
+		Namespace:  "Other",
+		Dimensions: [][]string{},
+		Metrics:    []common.MetricDefinition{{Name: "Latency"}},
+	})
+
+	parts := emf.Decompose()
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d", len(parts))
+	}
+	if len(parts[0].Dimensions) != 1 || parts[0].Dimensions["Service"] != "api" {
+		t.Errorf("Expected the first part to only have Service, got %v", parts[0].Dimensions)
+	}
+	if len(parts[1].Dimensions) != 2 {
+		t.Errorf("Expected the second part to have Service and Operation, got %v", parts[1].Dimensions)
+	}
+	if len(parts[2].Dimensions) != 0 || len(parts[2].AWS.CloudWatchMetrics[0].Dimensions) != 0 || parts[2].MetricData["Latency"].Value == nil {
+		t.Errorf("Expected a dimensionless part with the metric value, got %+v", parts[2])
+	}
+}
+
+func TestAggregateMetric_MergesLaterMetrics(t *testing.T) {
+	options := &common.PluginOptions{}
+	a := newTestAggregator(options)
+	first := rollupRecord("Get", 1)
+	second := rollupRecord("Get", 2)
+	directive := second["_aws"].(map[interface{}]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[interface{}]interface{})
+	directive["Metrics"] = []interface{}{map[interface{}]interface{}{"Name": "Errors"}, map[interface{}]interface{}{"Name": "Latency"}}
+	second["Errors"] = float64(1)
+
+	for _, record := range []map[interface{}]interface{}{first, second} {
+		emf, err := EmfFromRecord(record, nil, time.Now(), "", options)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		a.AggregateMetric(emf)
+	}
+
+	if len(a.metadataStore) != 1 {
+		t.Fatalf("Expected a single series, got %d", len(a.metadataStore))
+	}
+	for _, metadata := range a.metadataStore {
+		metrics := metadata.AWS.CloudWatchMetrics
+		if len(metrics) != 1 || len(metrics[0].Metrics) != 2 || metrics[0].Metrics[0].Name != "Latency" || metrics[0].Metrics[1].Name != "Errors" {
+			t.Errorf("Expected Errors to be declared after Latency, got %+v", metrics)
+		}
+	}
+}
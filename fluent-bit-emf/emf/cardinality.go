@@ -0,0 +1,192 @@
+package emf
+
+import (
+	"fmt"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/log"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// OverflowValue replaces every dimension and key property value of a series folded into the
+// overflow series
+const OverflowValue = "__other__"
+
+// CardinalityStats counts the distinct new series over a cardinality limit, by how they were
+// handled. A metric over its own limit counts as a series of its own
+type CardinalityStats struct {
+	Folded  int
+	Dropped int
+}
+
+type namespacedMetric struct {
+	namespace string
+	name      string
+}
+
+// cardinalityLimiter counts the distinct series of an aggregation period so a dimension with
+// unbounded values, like a request id, can't grow the aggregation state without limit
+type cardinalityLimiter struct {
+	maxSeries             int
+	maxSeriesPerNamespace int
+	maxSeriesPerMetric    int
+
+	series     int
+	namespaces map[string]int
+	metrics    map[namespacedMetric]int
+	// distinct values of each dimension and key property, to point at the one causing the series
+	values     map[string]map[string]bool
+	properties map[string]map[string]bool
+	// limits already warned about this period
+	warned map[string]bool
+	// series already folded or dropped this period, so each is only counted once
+	overflowed map[string]bool
+}
+
+func newCardinalityLimiter(options *common.PluginOptions) *cardinalityLimiter {
+	l := &cardinalityLimiter{
+		maxSeries:             options.MaxSeries,
+		maxSeriesPerNamespace: options.MaxSeriesPerNamespace,
+		maxSeriesPerMetric:    options.MaxSeriesPerMetric,
+	}
+	l.reset()
+	return l
+}
+
+// exceeded returns the limit a new series for the record would go over, empty when it's under
+// all of them. The limit per metric is checked separately by metricsExceeded
+func (l *cardinalityLimiter) exceeded(emf *EMFMetric) string {
+	if l.maxSeries > 0 && l.series >= l.maxSeries {
+		return fmt.Sprintf("limit of %d series", l.maxSeries)
+	}
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		if l.maxSeriesPerNamespace > 0 && l.namespaces[def.Namespace] >= l.maxSeriesPerNamespace {
+			return fmt.Sprintf("limit of %d series in namespace %s", l.maxSeriesPerNamespace, def.Namespace)
+		}
+	}
+	return ""
+}
+
+// metricsExceeded returns the metrics of the record that are new to its series and at their
+// limit, along with the last limit reached, and counts the series of the other new ones. isNew
+// tells whether the series already has a metric
+func (l *cardinalityLimiter) metricsExceeded(emf *EMFMetric, isNew func(name string) bool) ([]string, string) {
+	if l.maxSeriesPerMetric == 0 {
+		return nil, ""
+	}
+	var over []string
+	limit := ""
+	// a metric is over when it's at the limit in any of its namespaces
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		for _, metric := range def.Metrics {
+			if _, exists := emf.MetricData[metric.Name]; !exists || !isNew(metric.Name) {
+				continue
+			}
+			if l.metrics[namespacedMetric{def.Namespace, metric.Name}] >= l.maxSeriesPerMetric && utils.Find(over, func(name string) bool { return name == metric.Name }) == -1 {
+				over = append(over, metric.Name)
+				limit = fmt.Sprintf("limit of %d series for metric %s in namespace %s", l.maxSeriesPerMetric, metric.Name, def.Namespace)
+			}
+		}
+	}
+	// the same metric can be declared more than once in a namespace, it's still one series
+	var counted map[namespacedMetric]bool
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		for _, metric := range def.Metrics {
+			key := namespacedMetric{def.Namespace, metric.Name}
+			if _, exists := emf.MetricData[metric.Name]; !exists || !isNew(metric.Name) || counted[key] || utils.Find(over, func(name string) bool { return name == metric.Name }) != -1 {
+				continue
+			}
+			if counted == nil {
+				counted = make(map[namespacedMetric]bool)
+			}
+			counted[key] = true
+			l.metrics[key]++
+		}
+	}
+	return over, limit
+}
+
+// firstOverflow reports whether the series is folded or dropped for the first time this period
+func (l *cardinalityLimiter) firstOverflow(series string) bool {
+	if l.overflowed[series] {
+		return false
+	}
+	l.overflowed[series] = true
+	return true
+}
+
+// add counts a new series for the record, its metrics are counted by metricsExceeded
+func (l *cardinalityLimiter) add(emf *EMFMetric) {
+	l.series++
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		l.namespaces[def.Namespace]++
+	}
+	count := func(values map[string]map[string]bool, name string, value string) {
+		if values[name] == nil {
+			values[name] = make(map[string]bool)
+		}
+		values[name][value] = true
+	}
+	for name, value := range emf.Dimensions {
+		count(l.values, name, value)
+	}
+	for name, value := range emf.KeyProperties {
+		count(l.properties, name, value)
+	}
+}
+
+// warn logs the first time a limit is reached in a period, naming the record's dimension or key
+// property with the most distinct values as the likely cause
+func (l *cardinalityLimiter) warn(limit string, emf *EMFMetric, action string) {
+	if l.warned[limit] {
+		return
+	}
+	l.warned[limit] = true
+
+	offender, distinct := "", 0
+	consider := func(kind string, names map[string]string, values map[string]map[string]bool) {
+		for name := range names {
+			candidate := kind + " " + name
+			if count := len(values[name]); count > distinct || (count == distinct && candidate < offender) {
+				offender, distinct = candidate, count
+			}
+		}
+	}
+	consider("dimension", emf.Dimensions, l.values)
+	consider("key property", emf.KeyProperties, l.properties)
+	if offender == "" {
+		log.Warn().Printf("Reached the %s, new series are %s until the next flush\n", limit, action)
+		return
+	}
+	log.Warn().Printf("Reached the %s, new series are %s until the next flush; %s has the most distinct values (%d)\n", limit, action, offender, distinct)
+}
+
+// reset starts counting a new period
+func (l *cardinalityLimiter) reset() {
+	l.series = 0
+	l.namespaces = make(map[string]int)
+	l.metrics = make(map[namespacedMetric]int)
+	l.values = make(map[string]map[string]bool)
+	l.properties = make(map[string]map[string]bool)
+	l.warned = make(map[string]bool)
+	l.overflowed = make(map[string]bool)
+}
+
+// overflow returns the record with every dimension and key property value replaced by
+// OverflowValue, it's aggregated in the overflow series regardless of the limits
+func (emf *EMFMetric) overflow() *EMFMetric {
+	folded := *emf
+	folded.Dimensions = make(map[string]string, len(emf.Dimensions))
+	for name := range emf.Dimensions {
+		folded.Dimensions[name] = OverflowValue
+	}
+	// key properties are part of the series key too, left as is they'd still make new series
+	if emf.KeyProperties != nil {
+		folded.KeyProperties = make(map[string]string, len(emf.KeyProperties))
+		for name := range emf.KeyProperties {
+			folded.KeyProperties[name] = OverflowValue
+		}
+	}
+	folded.Overflow = true
+	return &folded
+}
@@ -0,0 +1,159 @@
+package emf
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+func TestAggregateMetric_CardinalityLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options common.PluginOptions
+		series  int
+		stats   CardinalityStats
+		// values in the overflow series
+		folded uint64
+	}{
+		{name: "unlimited", series: 4},
+		{name: "overall", options: common.PluginOptions{MaxSeries: 2}, series: 3, stats: CardinalityStats{Folded: 2}, folded: 3},
+		{name: "namespace", options: common.PluginOptions{MaxSeriesPerNamespace: 3}, series: 4, stats: CardinalityStats{Folded: 1}, folded: 1},
+		{name: "metric", options: common.PluginOptions{MaxSeriesPerMetric: 1}, series: 2, stats: CardinalityStats{Folded: 3}, folded: 4},
+		{
+			name:    "drop",
+			options: common.PluginOptions{MaxSeries: 2, CardinalityOverflow: common.CardinalityOverflowDrop},
+			series:  2,
+			stats:   CardinalityStats{Dropped: 2},
+		},
+	} {
+		options := tc.options
+		a := newTestAggregator(&options)
+		// a series over the limit is only counted once however many records it has
+		for i, operation := range []string{"Get", "Put", "List", "Delete", "Get", "List"} {
+			emf, err := EmfFromRecord(rollupRecord(operation, float64(i)), nil, time.Now(), "", &options)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			a.AggregateMetric(emf)
+		}
+
+		if len(a.metrics) != tc.series {
+			t.Errorf("%s: expected %d series, got %d", tc.name, tc.series, len(a.metrics))
+		}
+		if a.stats.Cardinality != tc.stats {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.stats, a.stats.Cardinality)
+		}
+		for key, metadata := range a.metadataStore {
+			if metadata.Dimensions["Operation"] != OverflowValue {
+				continue
+			}
+			if metadata.Dimensions["Service"] != OverflowValue {
+				t.Errorf("%s: expected every dimension of the overflow series replaced, got %v", tc.name, metadata.Dimensions)
+			}
+			count := uint64(0)
+			for _, c := range a.metrics[key]["Latency"].Reduce().Counts {
+				count += c
+			}
+			if count != tc.folded {
+				t.Errorf("%s: expected the overflow series to hold the %d folded values, got %d", tc.name, tc.folded, count)
+			}
+		}
+	}
+}
+
+func TestAggregateMetric_MetricCardinalityLimit(t *testing.T) {
+	options := &common.PluginOptions{MaxSeriesPerMetric: 1}
+	a := newTestAggregator(options)
+	records := []map[interface{}]interface{}{rollupRecord("Get", 1), rollupRecord("Put", 2), rollupRecord("Put", 3)}
+	// Put also has Errors, which is still under its limit
+	for _, record := range records[1:] {
+		metrics := record["_aws"].(map[interface{}]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[interface{}]interface{})
+		metrics["Metrics"] = append(metrics["Metrics"].([]interface{}), map[interface{}]interface{}{"Name": "Errors"})
+		record["Errors"] = float64(1)
+	}
+	for _, record := range records {
+		emf, err := EmfFromRecord(record, nil, time.Now(), "", options)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		a.AggregateMetric(emf)
+	}
+
+	if a.stats.Cardinality != (CardinalityStats{Folded: 1}) {
+		t.Errorf("Expected the Latency of Put to be folded once, got %+v", a.stats.Cardinality)
+	}
+	found := 0
+	for key, metadata := range a.metadataStore {
+		metrics := a.metrics[key]
+		switch metadata.Dimensions["Operation"] {
+		case "Put":
+			found++
+			if _, exists := metrics["Latency"]; exists || metrics["Errors"] == nil || len(metrics["Errors"].Reduce().Values) != 1 || metrics["Errors"].Reduce().Counts[0] != 2 {
+				t.Errorf("Expected Put to only have both Errors values, got %v", metrics)
+			}
+			if declared := metadata.AWS.CloudWatchMetrics[0].Metrics; len(declared) != 1 || declared[0].Name != "Errors" {
+				t.Errorf("Expected Put to only declare Errors, got %v", declared)
+			}
+		case OverflowValue:
+			found++
+			if _, exists := metrics["Errors"]; exists || metrics["Latency"] == nil || metrics["Latency"].Reduce().Sum != 5 {
+				t.Errorf("Expected the overflow series to only have both Latency values of Put, got %v", metrics)
+			}
+		}
+	}
+	if found != 2 {
+		t.Errorf("Expected a Put and an overflow series, got %d of them", found)
+	}
+}
+
+func TestCardinalityLimiter_Reset(t *testing.T) {
+	options := &common.PluginOptions{MaxSeries: 1}
+	l := newCardinalityLimiter(options)
+	emf, err := EmfFromRecord(rollupRecord("Get", 1), nil, time.Now(), "", options)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	l.add(emf)
+	if l.exceeded(emf) == "" {
+		t.Errorf("Expected the limit to be reached")
+	}
+	l.reset()
+	if limit := l.exceeded(emf); limit != "" {
+		t.Errorf("Expected a new period to be under the limit, got %s", limit)
+	}
+}
+
+func TestAggregateMetric_CardinalityLimitsKeyProperties(t *testing.T) {
+	options := &common.PluginOptions{MaxSeries: 2, RetainedProperties: map[string]string{"RequestId": common.RetainKey}}
+	a := newTestAggregator(options)
+	for i := 0; i < 50; i++ {
+		record := rollupRecord("Get", float64(i))
+		record["RequestId"] = fmt.Sprintf("request-%d", i)
+		emf, err := EmfFromRecord(record, nil, time.Now(), "", options)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		a.AggregateMetric(emf)
+	}
+
+	// the two under the limit and the overflow series
+	if len(a.metrics) != 3 {
+		t.Errorf("Expected 3 series, got %d", len(a.metrics))
+	}
+	if a.stats.Cardinality.Folded != 48 {
+		t.Errorf("Expected 48 folded series, got %+v", a.stats.Cardinality)
+	}
+	overflow := 0
+	for _, metadata := range a.metadataStore {
+		fields := make(map[string]interface{})
+		metadata.Properties.fields(fields)
+		if fields["RequestId"] == OverflowValue {
+			overflow++
+		}
+	}
+	if overflow != 1 {
+		t.Errorf("Expected the overflow series to have RequestId %s, got %d such series", OverflowValue, overflow)
+	}
+}
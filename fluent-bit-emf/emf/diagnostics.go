@@ -0,0 +1,86 @@
+package emf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/log"
+)
+
+// Diagnostic reasons, kept short and stable so they can be counted
+const (
+	ReasonNotAMap      = "not a map"
+	ReasonNotAnArray   = "not an array"
+	ReasonMissingField = "missing field"
+	ReasonEmptyField   = "empty field"
+	ReasonNoMetrics    = "no valid metrics"
+	ReasonInvalidValue = "invalid value"
+	ReasonNameConflict = "name conflict"
+	ReasonNoDimensions = "no dimension sets"
+)
+
+// Diagnostic describes part of a record that was dropped while the rest of it was kept
+type Diagnostic struct {
+	// Record is the index of the record in its chunk
+	Record int
+	// Path is the JSON path of the dropped part, e.x. _aws.CloudWatchMetrics[0].Metrics[1]
+	Path   string
+	Reason string
+	Detail string
+}
+
+func (d Diagnostic) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("record %d: %s: %s", d.Record, d.Path, d.Reason)
+	}
+	return fmt.Sprintf("record %d: %s: %s: %s", d.Record, d.Path, d.Reason, d.Detail)
+}
+
+// Diagnostics collects the diagnostics of one record
+type Diagnostics []Diagnostic
+
+func (d *Diagnostics) add(path string, reason string, format string, v ...interface{}) {
+	*d = append(*d, Diagnostic{Path: path, Reason: reason, Detail: fmt.Sprintf(format, v...)})
+}
+
+// diagnosticLog counts diagnostics by reason and logs one in every sampleRate of them so a
+// misbehaving producer can't flood the fluent-bit log, 0 only counts
+type diagnosticLog struct {
+	sampleRate int
+	seen       int
+	counts     map[string]int
+}
+
+func newDiagnosticLog(sampleRate int) *diagnosticLog {
+	return &diagnosticLog{
+		sampleRate: sampleRate,
+		counts:     make(map[string]int),
+	}
+}
+
+func (l *diagnosticLog) record(diagnostic Diagnostic) {
+	l.counts[diagnostic.Reason]++
+	if l.sampleRate > 0 && l.seen%l.sampleRate == 0 {
+		log.Warn().Printf("Dropped part of an EMF record, %s (1 in %d logged)\n", diagnostic, l.sampleRate)
+	}
+	l.seen++
+}
+
+// summary returns the counts by reason, e.x. "3 not a map, 1 missing field", and resets them
+func (l *diagnosticLog) summary() string {
+	if len(l.counts) == 0 {
+		return ""
+	}
+	reasons := make([]string, 0, len(l.counts))
+	for reason := range l.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%d %s", l.counts[reason], reason)
+	}
+	l.counts = make(map[string]int)
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,98 @@
+package emf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+func TestEmfFromRecord_Salvage(t *testing.T) {
+	input := map[interface{}]interface{}{
+		"_aws": map[interface{}]interface{}{
+			"Timestamp": int64(1700000000000),
+			"CloudWatchMetrics": []interface{}{
+				"not a directive",
+				map[interface{}]interface{}{
+					"Dimensions": []interface{}{},
+					"Metrics":    []interface{}{map[interface{}]interface{}{"Name": "NoNamespace"}},
+				},
+				map[interface{}]interface{}{
+					"Namespace":  "Good",
+					"Dimensions": []interface{}{[]interface{}{"Service"}, "Operation"},
+					"Metrics": []interface{}{
+						map[interface{}]interface{}{"Name": "Latency", "Unit": "Milliseconds"},
+						map[interface{}]interface{}{"Unit": "Count"},
+						"Errors",
+					},
+				},
+				map[interface{}]interface{}{
+					"Namespace":  "NoMetrics",
+					"Dimensions": []interface{}{},
+					"Metrics":    []interface{}{map[interface{}]interface{}{}},
+				},
+			},
+		},
+		"Service": "api",
+		"Latency": float64(12),
+	}
+
+	emf, err := EmfFromRecord(input, nil, time.Now(), "", &common.PluginOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []common.ProjectionDefinition{{
+		Namespace:  "Good",
+		Dimensions: [][]string{{"Service"}},
+		Metrics:    []common.MetricDefinition{{Name: "Latency", Unit: "Milliseconds"}},
+	}}
+	if !reflect.DeepEqual(emf.AWS.CloudWatchMetrics, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, emf.AWS.CloudWatchMetrics)
+	}
+
+	paths := make([]string, len(emf.Diagnostics))
+	for i, diagnostic := range emf.Diagnostics {
+		paths[i] = diagnostic.Path + ": " + diagnostic.Reason
+	}
+	expectedPaths := []string{
+		"_aws.CloudWatchMetrics[0]: " + ReasonNotAMap,
+		"_aws.CloudWatchMetrics[1].Namespace: " + ReasonMissingField,
+		"_aws.CloudWatchMetrics[2].Dimensions[1]: " + ReasonNotAnArray,
+		"_aws.CloudWatchMetrics[2].Metrics[1].Name: " + ReasonMissingField,
+		"_aws.CloudWatchMetrics[2].Metrics[2]: " + ReasonNotAMap,
+		"_aws.CloudWatchMetrics[3].Metrics[0].Name: " + ReasonMissingField,
+		"_aws.CloudWatchMetrics[3].Metrics: " + ReasonNoMetrics,
+	}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Expected diagnostics %v, got %v", expectedPaths, paths)
+	}
+}
+
+func TestEmfFromRecord_NoValidDirectives(t *testing.T) {
+	input := map[interface{}]interface{}{
+		"_aws": map[interface{}]interface{}{
+			"Timestamp":         int64(1700000000000),
+			"CloudWatchMetrics": []interface{}{map[interface{}]interface{}{"Namespace": "NoDimensions"}},
+		},
+	}
+	if _, err := EmfFromRecord(input, nil, time.Now(), "", &common.PluginOptions{}); err == nil {
+		t.Error("Expected an error when no directive is valid")
+	}
+}
+
+func TestDiagnosticLog(t *testing.T) {
+	l := newDiagnosticLog(0)
+	for i := 0; i < 3; i++ {
+		l.record(Diagnostic{Reason: ReasonNotAMap})
+	}
+	l.record(Diagnostic{Reason: ReasonMissingField})
+
+	if summary := l.summary(); summary != "1 missing field, 3 not a map" {
+		t.Errorf("Unexpected summary %q", summary)
+	}
+	if summary := l.summary(); summary != "" {
+		t.Errorf("Expected the counts to be reset, got %q", summary)
+	}
+}
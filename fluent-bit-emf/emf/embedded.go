@@ -0,0 +1,87 @@
+package emf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// unwrapEmbedded finds an EMF document embedded as a JSON string in one of the candidate keys,
+// as container runtimes leave it in log or message. Anything before the JSON object, like a CRI
+// timestamp and stream header, is skipped. The record is returned as is when it has _aws itself
+func unwrapEmbedded(record map[interface{}]interface{}, keys []string) (map[interface{}]interface{}, error) {
+	if _, exists := record["_aws"]; exists {
+		return record, nil
+	}
+	for _, key := range keys {
+		var raw []byte
+		switch v := record[key].(type) {
+		case string:
+			raw = []byte(v)
+		case []byte:
+			raw = v
+		default:
+			continue
+		}
+		if document := parseEmbedded(raw); document != nil {
+			return document, nil
+		}
+	}
+	return nil, fmt.Errorf("no aws metadata from found in record; likely means malformed record")
+}
+
+// maxEmbeddedAttempts bounds the decodes of a single value, each can read the rest of it
+const maxEmbeddedAttempts = 8
+
+// parseEmbedded tries each '{' that starts like an object with a key as the start of the document,
+// so braces in a prefix don't stop the real document from being found. The first object that
+// decodes is the document, it returns nil if that isn't EMF or no object decodes
+func parseEmbedded(raw []byte) map[interface{}]interface{} {
+	attempts := 0
+	for offset := bytes.IndexByte(raw, '{'); offset != -1 && attempts < maxEmbeddedAttempts; {
+		if startsObject(raw[offset+1:]) {
+			attempts++
+			decoder := json.NewDecoder(bytes.NewReader(raw[offset:]))
+			// numbers stay exact, the metric parsing understands json.Number
+			decoder.UseNumber()
+			var document map[string]interface{}
+			if err := decoder.Decode(&document); err == nil {
+				if _, exists := document["_aws"]; exists {
+					return fromJSON(document).(map[interface{}]interface{})
+				}
+				return nil
+			}
+		}
+		next := bytes.IndexByte(raw[offset+1:], '{')
+		if next == -1 {
+			break
+		}
+		offset += next + 1
+	}
+	return nil
+}
+
+// startsObject reports whether what follows a '{' is the first key of a JSON object
+func startsObject(rest []byte) bool {
+	rest = bytes.TrimLeft(rest, " \t\r\n")
+	return len(rest) > 0 && rest[0] == '"'
+}
+
+// fromJSON converts decoded JSON into the shapes msgpack decoding produces
+func fromJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[interface{}]interface{}, len(v))
+		for key, val := range v {
+			converted[key] = fromJSON(val)
+		}
+		return converted
+	case []interface{}:
+		for i := range v {
+			v[i] = fromJSON(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
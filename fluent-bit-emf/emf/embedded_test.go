@@ -0,0 +1,79 @@
+package emf
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+const embeddedDocument = `{"_aws":{"Timestamp":1700000000123,"CloudWatchMetrics":[{"Namespace":"TestNamespace","Dimensions":[["Service"]],"Metrics":[{"Name":"Latency","Unit":"Milliseconds"}]}]},"Service":"api","Latency":[12,15,12]}`
+
+func TestEmfFromRecord_Embedded(t *testing.T) {
+	testCases := []struct {
+		name   string
+		record map[interface{}]interface{}
+	}{
+		{
+			name:   "Docker log field",
+			record: map[interface{}]interface{}{"log": embeddedDocument + "\n", "stream": "stdout"},
+		},
+		{
+			name:   "Message bytes",
+			record: map[interface{}]interface{}{"message": []byte(embeddedDocument)},
+		},
+		{
+			name:   "CRI prefix",
+			record: map[interface{}]interface{}{"log": "2023-11-14T22:13:20.123456789Z stdout F " + embeddedDocument},
+		},
+		{
+			name:   "Brace in prefix",
+			record: map[interface{}]interface{}{"log": "{not json} " + embeddedDocument},
+		},
+		{
+			name:   "Many braces in prefix",
+			record: map[interface{}]interface{}{"log": strings.Repeat("{", 100000) + embeddedDocument},
+		},
+		{
+			name:   "Invalid objects in prefix",
+			record: map[interface{}]interface{}{"log": `{"level": {"info" ` + embeddedDocument},
+		},
+	}
+
+	options := &common.PluginOptions{EmbeddedKeys: []string{"log", "message"}}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			emf, err := EmfFromRecord(tc.record, nil, time.Now(), "", options)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if emf.AWS.Timestamp != 1700000000123 {
+				t.Errorf("Expected timestamp 1700000000123, got %d", emf.AWS.Timestamp)
+			}
+			if emf.Dimensions["Service"] != "api" {
+				t.Errorf("Expected the Service dimension, got %v", emf.Dimensions)
+			}
+			if latency := emf.MetricData["Latency"]; len(latency.Values) != 3 || latency.Values[1] != 15 {
+				t.Errorf("Expected the Latency values, got %+v", latency)
+			}
+		})
+	}
+}
+
+func TestEmfFromRecord_EmbeddedInvalid(t *testing.T) {
+	options := &common.PluginOptions{EmbeddedKeys: []string{"log"}}
+	for _, record := range []map[interface{}]interface{}{
+		{"log": "plain text"},
+		{"log": `{"not":"emf"}`},
+		{"log": `{"_aws":` + "truncated"},
+		// the first object is the document, one after it isn't looked for
+		{"log": `{"level":"info"} ` + embeddedDocument},
+		{"log": strings.Repeat(`{"a":`, maxEmbeddedAttempts) + embeddedDocument},
+		{"message": embeddedDocument},
+	} {
+		if _, err := EmfFromRecord(record, nil, time.Now(), "", options); err == nil {
+			t.Errorf("Expected error for %v", record)
+		}
+	}
+}
@@ -2,22 +2,24 @@ package emf
 
 import (
 	"fmt"
-	"reflect"
 	"sort"
+	"time"
 
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/dimension"
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/log"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/metric"
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
 )
 
 type MetricValue struct {
 	Value  *float64  `json:"Value,omitempty"`
 	Values []float64 `json:"Values,omitempty"`
-	Counts []uint    `json:"Counts,omitempty"`
+	Counts []uint64  `json:"Counts,omitempty"`
 	Min    *float64  `json:"Min,omitempty"`
 	Max    *float64  `json:"Max,omitempty"`
 	Sum    *float64  `json:"Sum,omitempty"`
-	Count  *uint     `json:"Count,omitempty"`
+	Count  *uint64   `json:"Count,omitempty"`
 }
 
 type EMFMetric struct {
@@ -26,14 +28,42 @@ type EMFMetric struct {
 	Dimensions   map[string]string      `json:"-"`
 	MetricData   map[string]MetricValue `json:"-"`
 	Tag          string                 `json:"-"`
+	// Metadata is the fluent-bit 2.x+ per event metadata, empty for older versions
+	Metadata map[interface{}]interface{} `json:"-"`
+	// TimestampClamped is set when the timestamp was outside the accepted window
+	TimestampClamped bool `json:"-"`
+	// Diagnostics describe the parts of the record that were dropped
+	Diagnostics Diagnostics `json:"-"`
+	// Split is set on the part of a record split off for a unit conflict, it's aggregated in a
+	// separate series for SplitUnit, which is empty for values without a unit
+	Split     bool   `json:"-"`
+	SplitUnit string `json:"-"`
+	// KeyProperties are the retained properties that are part of the series key
+	KeyProperties map[string]string `json:"-"`
+	// Properties are the other retained properties, kept by the series with their policy
+	Properties map[string]interface{} `json:"-"`
+	// Overflow is set once a record over a cardinality limit has been folded into the overflow series
+	Overflow bool `json:"-"`
 }
 
 // EMF structures remain the same, but we'll add a new constructor
-func EmfFromRecord(record map[interface{}]interface{}) (*EMFMetric, error) {
+// metadata is the fluent-bit 2.x+ per event metadata, nil for older versions
+// recordTime is the fluent-bit record timestamp, used when the record has none of its own
+// tag is the fluent-bit tag of the record
+func EmfFromRecord(record map[interface{}]interface{}, metadata map[interface{}]interface{}, recordTime time.Time, tag string, options *common.PluginOptions) (*EMFMetric, error) {
 	emf := &EMFMetric{
 		MetricData:   make(map[string]MetricValue),
 		DimensionSet: make(map[string]bool),
 		Dimensions:   make(map[string]string),
+		Tag:          tag,
+		Metadata:     metadata,
+	}
+
+	// injected dimensions come from the fluent-bit record rather than the embedded EMF
+	event := record
+	record, err := unwrapEmbedded(record, options.EmbeddedKeys)
+	if err != nil {
+		return nil, err
 	}
 
 	if rawAwsData, exists := record["_aws"]; !exists {
@@ -44,105 +74,53 @@ func EmfFromRecord(record map[interface{}]interface{}) (*EMFMetric, error) {
 		} else {
 			aws := &common.AWSMetadata{}
 
-			// Handle Timestamp
+			// Handle Timestamp, falling back to when fluent-bit received the record
 			if ts, exists := awsData["Timestamp"]; !exists {
-				return nil, fmt.Errorf("no timestamp was found in aws data; likely means malformed record")
+				aws.Timestamp = recordTime.UnixMilli()
+			} else if timestamp, err := parseTimestamp(ts, options.TimestampUnit); err != nil {
+				return nil, err
 			} else {
-				switch v := ts.(type) {
-				case int64:
-					aws.Timestamp = v
-				case int:
-					aws.Timestamp = int64(v)
-				case uint:
-					aws.Timestamp = int64(v)
-				case uint32:
-					aws.Timestamp = int64(v)
-				case uint64:
-					aws.Timestamp = int64(v)
-				default:
-					return nil, fmt.Errorf("timestamp was not int, int64, uint, uint32, or uint64; was %v", reflect.TypeOf(v))
-				}
+				aws.Timestamp = timestamp
+			}
+			if timestamp, clamped := clampTimestamp(aws.Timestamp, time.Now(), options.TimestampMaxPast, options.TimestampMaxFuture); clamped {
+				log.Debug().Printf("Clamped timestamp %d to %d\n", aws.Timestamp, timestamp)
+				aws.Timestamp = timestamp
+				emf.TimestampClamped = true
 			}
 
-			// Handle CloudWatch Metrics
+			// Handle CloudWatch Metrics, keeping only the directives that are fully valid
 			if cwMetrics, exists := awsData["CloudWatchMetrics"]; !exists {
 				return nil, fmt.Errorf("no CloudWatchMetrics key was found; likely means malformed record")
 			} else {
 				if metricsArray, ok := cwMetrics.([]interface{}); !ok {
 					return nil, fmt.Errorf("CloudWatchMetrics is not an array; likely means malformed record")
 				} else {
-					aws.CloudWatchMetrics = make([]common.ProjectionDefinition, len(metricsArray))
+					aws.CloudWatchMetrics = make([]common.ProjectionDefinition, 0, len(metricsArray))
 					for i, metricDef := range metricsArray {
-						if md, ok := metricDef.(map[interface{}]interface{}); !ok {
-							log.Warn().Printf("Skipping metric: Metric definition was not a map, was %v\n", metricDef)
-							continue
-						} else {
-							// Parse Namespace
-							if ns, exists := md["Namespace"]; !exists {
-								log.Warn().Println("Skipping metric: Metric definition had no Namespace field")
+						path := fmt.Sprintf("_aws.CloudWatchMetrics[%d]", i)
+						if def, ok := parseDirective(metricDef, path, &emf.Diagnostics); ok {
+							if !dropDimensions(&def, options.DropDimensions) {
+								emf.Diagnostics.add(path+".Dimensions", ReasonNoDimensions, "every set was dropped")
 								continue
-							} else {
-								aws.CloudWatchMetrics[i].Namespace = utils.ToString(ns)
 							}
-
-							// Parse Dimensions
-							if dims, exists := md["Dimensions"]; !exists {
-								log.Warn().Println("Skipping metric: Metric definition had no Dimensions field")
-								continue
-							} else {
-								if dimArray, ok := dims.([]interface{}); !ok {
-									log.Warn().Printf("Skipping metric: Dimensions was not an array, was %v\n", dims)
-									continue
-								} else {
-									aws.CloudWatchMetrics[i].Dimensions = make([][]string, len(dimArray))
-									for j, dim := range dimArray {
-										if dimSet, ok := dim.([]interface{}); !ok {
-											log.Warn().Printf("Skipping dimension set: was not an array, was %v\n", dim)
-											continue
-										} else {
-											dimStrings := make([]string, len(dimSet))
-											for k, d := range dimSet {
-												dimStrings[k] = utils.ToString(d)
-												emf.DimensionSet[utils.ToString(d)] = true
-											}
-											// we sort here so we can do easy comparisons later
-											sort.Strings(dimStrings)
-											aws.CloudWatchMetrics[i].Dimensions[j] = dimStrings
-										}
-									}
-								}
-							}
-
-							// Parse Metrics
-							if metrics, exists := md["Metrics"]; !exists {
-								log.Warn().Println("Skipping metric: Metric definition had no Metrics field")
-								continue
-							} else {
-								if metricsArray, ok := metrics.([]interface{}); !ok {
-									log.Warn().Printf("Skipping metric: Metrics was not an array, was %v\n", metrics)
-									continue
-								} else {
-									aws.CloudWatchMetrics[i].Metrics = make([]common.MetricDefinition, len(metricsArray))
-
-									for j, metric := range metricsArray {
-										if m, ok := metric.(map[interface{}]interface{}); !ok {
-											log.Warn().Printf("Skipping metric: Metric was not a map, was %v\n", metric)
-											continue
-										} else {
-											aws.CloudWatchMetrics[i].Metrics[j].Name = utils.ToString(m["Name"])
-											aws.CloudWatchMetrics[i].Metrics[j].Unit = utils.ToString(m["Unit"])
-										}
-									}
+							for _, dimSet := range def.Dimensions {
+								for _, d := range dimSet {
+									emf.DimensionSet[d] = true
 								}
 							}
+							aws.CloudWatchMetrics = append(aws.CloudWatchMetrics, def)
 						}
 					}
+					if len(metricsArray) > 0 && len(aws.CloudWatchMetrics) == 0 {
+						return nil, fmt.Errorf("none of the %d CloudWatchMetrics directives were valid: %v", len(metricsArray), emf.Diagnostics)
+					}
 				}
 			}
 			emf.AWS = aws
 		}
 	}
 
+	var invalid []string
 	for key, value := range record {
 		strKey := utils.ToString(key)
 		switch strKey {
@@ -156,7 +134,15 @@ func EmfFromRecord(record map[interface{}]interface{}) (*EMFMetric, error) {
 					for _, metric := range metricDef.Metrics {
 						if metric.Name == strKey {
 							isMetric = true
-							metricValue := parseMetricValue(value)
+							metricValue, err := parseMetricValue(value, options.InvalidValues == common.InvalidValuesCoerce)
+							if err != nil {
+								if options.InvalidValues == common.InvalidValuesDropMetric || options.InvalidValues == common.InvalidValuesCoerce {
+									emf.Diagnostics.add(strKey, ReasonInvalidValue, "%v", err)
+									invalid = append(invalid, strKey)
+									break
+								}
+								return nil, fmt.Errorf("invalid value for metric %s: %w", strKey, err)
+							}
 							emf.MetricData[strKey] = metricValue
 							break
 						}
@@ -169,54 +155,473 @@ func EmfFromRecord(record map[interface{}]interface{}) (*EMFMetric, error) {
 
 			if !isMetric {
 				if _, present := emf.DimensionSet[strKey]; present {
-					emf.Dimensions[strKey] = utils.ToString(value)
+					emf.Dimensions[strKey] = options.DimensionRules.Apply(strKey, utils.ToString(value))
+				} else {
+					emf.retainProperty(strKey, value, options.RetainedProperties)
 				}
 			}
 		}
 	}
 
+	// a dropped metric can't stay declared, nor can a directive left without metrics
+	if len(invalid) > 0 {
+		emf = emf.withMetrics(invalid, false)
+		if len(emf.AWS.CloudWatchMetrics) == 0 {
+			return nil, fmt.Errorf("none of the metrics had a valid value: %v", emf.Diagnostics)
+		}
+	}
+
+	injectDimensions(emf, event, options)
+
+	applyMetricRules(emf, options.MetricRules)
+
+	if err := validate(emf, options.Validation); err != nil {
+		return nil, err
+	}
+
 	return emf, nil
 }
 
-func parseMetricValue(value interface{}) MetricValue {
+// parseDirective returns a directive only if it has a Namespace, Dimensions and at least one valid
+// metric. Invalid dimension sets and metrics are dropped on their own since the rest of the
+// directive is still meaningful without them
+func parseDirective(raw interface{}, path string, diags *Diagnostics) (common.ProjectionDefinition, bool) {
+	def := common.ProjectionDefinition{}
+	md, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		diags.add(path, ReasonNotAMap, "was %v", raw)
+		return def, false
+	}
+
+	// Parse Namespace
+	if ns, exists := md["Namespace"]; !exists {
+		diags.add(path+".Namespace", ReasonMissingField, "")
+		return def, false
+	} else if def.Namespace = utils.ToString(ns); def.Namespace == "" {
+		diags.add(path+".Namespace", ReasonEmptyField, "")
+		return def, false
+	}
+
+	// Parse Dimensions
+	dims, exists := md["Dimensions"]
+	if !exists {
+		diags.add(path+".Dimensions", ReasonMissingField, "")
+		return def, false
+	}
+	dimArray, ok := dims.([]interface{})
+	if !ok {
+		diags.add(path+".Dimensions", ReasonNotAnArray, "was %v", dims)
+		return def, false
+	}
+	def.Dimensions = make([][]string, 0, len(dimArray))
+	for j, dim := range dimArray {
+		dimSet, ok := dim.([]interface{})
+		if !ok {
+			diags.add(fmt.Sprintf("%s.Dimensions[%d]", path, j), ReasonNotAnArray, "was %v", dim)
+			continue
+		}
+		dimStrings := make([]string, 0, len(dimSet))
+		for k, d := range dimSet {
+			if name := utils.ToString(d); name == "" || d == nil {
+				diags.add(fmt.Sprintf("%s.Dimensions[%d][%d]", path, j, k), ReasonEmptyField, "")
+				dimStrings = nil
+				break
+			} else {
+				dimStrings = append(dimStrings, name)
+			}
+		}
+		if dimStrings == nil {
+			continue
+		}
+		// we sort here so we can do easy comparisons later
+		sort.Strings(dimStrings)
+		def.Dimensions = append(def.Dimensions, dimStrings)
+	}
+
+	// Parse Metrics
+	metrics, exists := md["Metrics"]
+	if !exists {
+		diags.add(path+".Metrics", ReasonMissingField, "")
+		return def, false
+	}
+	metricsArray, ok := metrics.([]interface{})
+	if !ok {
+		diags.add(path+".Metrics", ReasonNotAnArray, "was %v", metrics)
+		return def, false
+	}
+	def.Metrics = make([]common.MetricDefinition, 0, len(metricsArray))
+	for j, metric := range metricsArray {
+		metricPath := fmt.Sprintf("%s.Metrics[%d]", path, j)
+		m, ok := metric.(map[interface{}]interface{})
+		if !ok {
+			diags.add(metricPath, ReasonNotAMap, "was %v", metric)
+			continue
+		}
+		name, exists := m["Name"]
+		if !exists || name == nil || utils.ToString(name) == "" {
+			diags.add(metricPath+".Name", ReasonMissingField, "")
+			continue
+		}
+		definition := common.MetricDefinition{Name: utils.ToString(name)}
+		if unit, exists := m["Unit"]; exists && unit != nil {
+			definition.Unit = utils.ToString(unit)
+		}
+		def.Metrics = append(def.Metrics, definition)
+	}
+	if len(def.Metrics) == 0 {
+		diags.add(path+".Metrics", ReasonNoMetrics, "")
+		return def, false
+	}
+	return def, true
+}
+
+// applyMetricRules drops, renames and moves the metrics of every directive. Metrics moved to
+// another namespace get a directive of their own with the same dimension sets. A metric renamed
+// to the name of another metric of the record is dropped, whichever order they're declared in,
+// and of the metrics renamed to the same name only the first declared is kept
+func applyMetricRules(emf *EMFMetric, rules metric.Rules) {
+	if len(rules) == 0 {
+		return
+	}
+	type applied struct {
+		namespace, name string
+		keep            bool
+	}
+	results := make([][]applied, len(emf.AWS.CloudWatchMetrics))
+	// the original name of every metric in data, to tell renames apart from redeclarations.
+	// Metrics keeping their name take it before any rename can
+	origins := make(map[string]string, len(emf.MetricData))
+	for i, def := range emf.AWS.CloudWatchMetrics {
+		results[i] = make([]applied, len(def.Metrics))
+		for j, m := range def.Metrics {
+			namespace, name, keep := rules.Apply(def.Namespace, m.Name)
+			results[i][j] = applied{namespace, name, keep}
+			if keep && name == m.Name {
+				origins[name] = name
+			}
+		}
+	}
+
+	data := make(map[string]MetricValue, len(emf.MetricData))
+	directives := make([]common.ProjectionDefinition, 0, len(emf.AWS.CloudWatchMetrics))
+	for i, def := range emf.AWS.CloudWatchMetrics {
+		// directives of this one by namespace
+		namespaces := make(map[string]int)
+		for j, m := range def.Metrics {
+			namespace, name, keep := results[i][j].namespace, results[i][j].name, results[i][j].keep
+			if !keep {
+				continue
+			}
+			if origin, exists := origins[name]; exists && origin != m.Name {
+				emf.Diagnostics.add(fmt.Sprintf("_aws.CloudWatchMetrics[%d].Metrics[%d]", i, j), ReasonNameConflict, "%s renamed to %s, which %s already is", m.Name, name, origin)
+				continue
+			}
+			origins[name] = m.Name
+			if value, exists := emf.MetricData[m.Name]; exists {
+				data[name] = value
+			}
+
+			index, exists := namespaces[namespace]
+			if !exists {
+				index = len(directives)
+				namespaces[namespace] = index
+				directives = append(directives, common.ProjectionDefinition{Namespace: namespace, Dimensions: def.Dimensions})
+			}
+			directives[index].Metrics = append(directives[index].Metrics, common.MetricDefinition{Name: name, Unit: m.Unit})
+		}
+	}
+	for i := range directives {
+		directives[i].Canonicalize()
+	}
+	emf.AWS.CloudWatchMetrics = directives
+	emf.MetricData = data
+}
+
+// injectDimensions adds the tag dimension and then the injected ones to the record, going
+// through the same rules as the record's own dimensions. Dropped dimensions aren't injected
+func injectDimensions(emf *EMFMetric, event map[interface{}]interface{}, options *common.PluginOptions) {
+	inject := func(name string, value string, placement string, target string) {
+		if !dropped(name, options.DropDimensions) {
+			emf.InjectDimension(name, options.DimensionRules.Apply(name, value), placement, target)
+		}
+	}
+	if options.TagDimension != "" {
+		inject(options.TagDimension, emf.Tag, dimension.PlacementAppend, "")
+	}
+	for _, injection := range options.DimensionInjections {
+		if value, ok := injection.Resolve(event, emf.Metadata); ok {
+			inject(injection.Name, value, injection.Placement, injection.Target)
+		}
+	}
+}
+
+// dropped reports whether the dimension matches any of the drop_dimensions globs
+func dropped(name string, patterns []string) bool {
+	return utils.Find(patterns, func(pattern string) bool { return utils.GlobMatch(pattern, name) }) != -1
+}
+
+// dropDimensions removes the dimensions matching any of the globs from every dimension set,
+// dropping the sets left empty or the same as another. It returns false when every set was
+// dropped, like validate the directive is then dropped rather than publishing its metrics
+// without the dimensions they were meant to have
+func dropDimensions(def *common.ProjectionDefinition, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	dimensions := make([][]string, 0, len(def.Dimensions))
+	for _, dimSet := range def.Dimensions {
+		kept := make([]string, 0, len(dimSet))
+		for _, name := range dimSet {
+			if !dropped(name, patterns) {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) > 0 || len(dimSet) == 0 {
+			dimensions = append(dimensions, kept)
+		}
+	}
+	if len(dimensions) == 0 && len(def.Dimensions) > 0 {
+		return false
+	}
+	def.Dimensions = dimensions
+	def.Canonicalize()
+	return true
+}
+
+// AddDimension adds a dimension that isn't in the record to every dimension set, or as the only
+// set of directives without one. A dimension the record already has is left as is
+func (emf *EMFMetric) AddDimension(name string, value string) {
+	emf.InjectDimension(name, value, dimension.PlacementAppend, "")
+}
+
+// InjectDimension adds a dimension that isn't in the record. Appended, it's added to every
+// dimension set with target in it, every set when target is empty, or as the only set of
+// directives without one. As a set, it's added as a set of its own next to the existing ones.
+// A dimension the record already has, or that no set would reference, is left out
+func (emf *EMFMetric) InjectDimension(name string, value string, placement string, target string) {
+	if _, present := emf.DimensionSet[name]; present {
+		return
+	}
+	added := false
+	for i := range emf.AWS.CloudWatchMetrics {
+		def := &emf.AWS.CloudWatchMetrics[i]
+		if placement == dimension.PlacementSet {
+			if len(def.Dimensions) == 0 {
+				// keep publishing the metrics without dimensions too
+				def.Dimensions = [][]string{{}}
+			}
+			def.Dimensions = append(def.Dimensions, []string{name})
+			added = true
+			continue
+		}
+		if len(def.Dimensions) == 0 {
+			if target == "" {
+				def.Dimensions = [][]string{{name}}
+				added = true
+			}
+			continue
+		}
+		for j, dimSet := range def.Dimensions {
+			if target != "" && utils.Find(dimSet, func(d string) bool { return d == target }) == -1 {
+				continue
+			}
+			dimSet = append(append(make([]string, 0, len(dimSet)+1), dimSet...), name)
+			// kept sorted so we can do easy comparisons later
+			sort.Strings(dimSet)
+			def.Dimensions[j] = dimSet
+			added = true
+		}
+	}
+	if added {
+		emf.DimensionSet[name] = true
+		emf.Dimensions[name] = value
+	}
+}
+
+// Decompose splits the record into one part per dimension set of every directive, each with a
+// single directive and only the dimensions and metrics of that set. A directive without any
+// dimension sets becomes a single part without dimensions
+func (emf *EMFMetric) Decompose() []*EMFMetric {
+	parts := make([]*EMFMetric, 0, len(emf.AWS.CloudWatchMetrics))
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		dimensionSets := def.Dimensions
+		if len(dimensionSets) == 0 {
+			dimensionSets = [][]string{nil}
+		}
+		for _, dimSet := range dimensionSets {
+			part := &EMFMetric{
+				AWS: &common.AWSMetadata{
+					Timestamp: emf.AWS.Timestamp,
+					CloudWatchMetrics: []common.ProjectionDefinition{{
+						Namespace:  def.Namespace,
+						Dimensions: [][]string{},
+						Metrics:    append(make([]common.MetricDefinition, 0, len(def.Metrics)), def.Metrics...),
+					}},
+				},
+				DimensionSet:     make(map[string]bool, len(dimSet)),
+				Dimensions:       make(map[string]string, len(dimSet)),
+				MetricData:       make(map[string]MetricValue, len(def.Metrics)),
+				Tag:              emf.Tag,
+				Metadata:         emf.Metadata,
+				TimestampClamped: emf.TimestampClamped,
+				KeyProperties:    emf.KeyProperties,
+				Properties:       emf.Properties,
+			}
+			if dimSet != nil {
+				part.AWS.CloudWatchMetrics[0].Dimensions = [][]string{append(make([]string, 0, len(dimSet)), dimSet...)}
+			}
+			for _, name := range dimSet {
+				part.DimensionSet[name] = true
+				if value, exists := emf.Dimensions[name]; exists {
+					part.Dimensions[name] = value
+				}
+			}
+			for _, metric := range def.Metrics {
+				if value, exists := emf.MetricData[metric.Name]; exists {
+					part.MetricData[metric.Name] = value
+				}
+			}
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// withMetrics returns the part of the record with only the named metrics, or every metric but
+// them when included isn't set, along with their declarations
+func (emf *EMFMetric) withMetrics(names []string, included bool) *EMFMetric {
+	keep := func(name string) bool {
+		return (utils.Find(names, func(n string) bool { return n == name }) != -1) == included
+	}
+	part := *emf
+	part.AWS = &common.AWSMetadata{Timestamp: emf.AWS.Timestamp}
+	part.MetricData = make(map[string]MetricValue, len(emf.MetricData))
+	for name, value := range emf.MetricData {
+		if keep(name) {
+			part.MetricData[name] = value
+		}
+	}
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		metrics := make([]common.MetricDefinition, 0, len(def.Metrics))
+		for _, metric := range def.Metrics {
+			if keep(metric.Name) {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) > 0 {
+			def.Metrics = metrics
+			part.AWS.CloudWatchMetrics = append(part.AWS.CloudWatchMetrics, def)
+		}
+	}
+	return &part
+}
+
+// NamespaceOf returns the namespace of the first directive declaring the metric
+func (emf *EMFMetric) NamespaceOf(name string) string {
+	for _, metricDef := range emf.AWS.CloudWatchMetrics {
+		for _, metric := range metricDef.Metrics {
+			if metric.Name == name {
+				return metricDef.Namespace
+			}
+		}
+	}
+	return ""
+}
+
+// parseMetricValue accepts every value shape EMF allows: a number, an array of numbers
+// each counted once, or an object with Values (and optionally Counts, defaulting to 1
+// each) and/or a Min, Max, Sum and Count statistic set. Anything that isn't a number
+// is an error unless coerce is set, in which case it becomes 0
+func parseMetricValue(value interface{}, coerce bool) (MetricValue, error) {
 	mv := MetricValue{}
+	toFloat, toUint := utils.ParseFloat64, utils.ParseUint64
+	if coerce {
+		toFloat = func(v interface{}) (float64, error) { return utils.ConvertToFloat64(v), nil }
+		toUint = func(v interface{}) (uint64, error) { return utils.ConvertToUint64(v), nil }
+	}
+	toFloats := func(field string, values []interface{}) ([]float64, error) {
+		floats := make([]float64, len(values))
+		for i, val := range values {
+			f, err := toFloat(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", field, i, err)
+			}
+			floats[i] = f
+		}
+		return floats, nil
+	}
 
 	switch v := value.(type) {
 	case map[interface{}]interface{}:
 		// Handle structured metric value
-		if values, ok := v["Values"].([]interface{}); ok {
-			mv.Values = make([]float64, len(values))
-			for i, val := range values {
-				mv.Values[i] = utils.ConvertToFloat64(val)
+		if rawValues, exists := v["Values"]; exists {
+			values, ok := rawValues.([]interface{})
+			if !ok {
+				return mv, fmt.Errorf("Values was not an array, was %v", rawValues)
+			}
+			var err error
+			if mv.Values, err = toFloats("Values", values); err != nil {
+				return mv, err
 			}
 		}
-		if counts, ok := v["Counts"].([]interface{}); ok {
-			mv.Counts = make([]uint, len(counts))
+		if rawCounts, exists := v["Counts"]; exists {
+			counts, ok := rawCounts.([]interface{})
+			if !ok {
+				return mv, fmt.Errorf("Counts was not an array, was %v", rawCounts)
+			}
+			if len(counts) != len(mv.Values) {
+				return mv, fmt.Errorf("Counts has %d entries but Values has %d", len(counts), len(mv.Values))
+			}
+			mv.Counts = make([]uint64, len(counts))
 			for i, count := range counts {
-				mv.Counts[i] = uint(utils.ConvertToFloat64(count))
+				u, err := toUint(count)
+				if err != nil {
+					return mv, fmt.Errorf("Counts[%d]: %w", i, err)
+				}
+				mv.Counts[i] = u
 			}
+		} else if mv.Values != nil {
+			mv.Counts = onesFor(mv.Values)
 		}
-		if min, ok := v["Min"]; ok {
-			value := utils.ConvertToFloat64(min)
-			mv.Min = &value
-		}
-		if max, ok := v["Max"]; ok {
-			value := utils.ConvertToFloat64(max)
-			mv.Max = &value
-		}
-		if sum, ok := v["Sum"]; ok {
-			value := utils.ConvertToFloat64(sum)
-			mv.Sum = &value
+		for field, target := range map[string]**float64{"Min": &mv.Min, "Max": &mv.Max, "Sum": &mv.Sum} {
+			if raw, ok := v[field]; ok {
+				value, err := toFloat(raw)
+				if err != nil {
+					return mv, fmt.Errorf("%s: %w", field, err)
+				}
+				*target = &value
+			}
 		}
 		if count, ok := v["Count"]; ok {
-			value := uint(utils.ConvertToFloat64(count))
+			value, err := toUint(count)
+			if err != nil {
+				return mv, fmt.Errorf("Count: %w", err)
+			}
 			mv.Count = &value
 		}
+	case []interface{}:
+		// Handle array value, every entry is one observation
+		var err error
+		if mv.Values, err = toFloats("Values", v); err != nil {
+			return mv, err
+		}
+		mv.Counts = onesFor(mv.Values)
 	default:
 		// Handle simple value
-		value := utils.ConvertToFloat64(v)
+		value, err := toFloat(v)
+		if err != nil {
+			return mv, err
+		}
 		mv.Value = &value
 	}
 
-	return mv
+	return mv, nil
+}
+
+func onesFor(values []float64) []uint64 {
+	counts := make([]uint64, len(values))
+	for i := range counts {
+		counts[i] = 1
+	}
+	return counts
 }
@@ -2,8 +2,14 @@ package emf
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/decoder"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/dimension"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/metric"
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
 )
 
@@ -31,15 +37,15 @@ func TestEmfFromRecord_ValidInput(t *testing.T) {
 		"DimensionName": "DimensionValue",
 	}
 
-	emf, err := EmfFromRecord(input)
+	emf, err := EmfFromRecord(input, nil, time.Now(), "", &common.PluginOptions{})
 
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	// Verify AWS metadata
-	if emf.AWS.Timestamp != 1234567890 {
-		t.Errorf("Expected timestamp 1234567890, got %d", emf.AWS.Timestamp)
+	// Verify AWS metadata, the timestamp is small enough to be epoch seconds
+	if emf.AWS.Timestamp != 1234567890000 {
+		t.Errorf("Expected timestamp 1234567890000, got %d", emf.AWS.Timestamp)
 	}
 
 	// Verify CloudWatchMetrics
@@ -68,9 +74,10 @@ func TestEmfFromRecord_InvalidInput(t *testing.T) {
 			input: map[interface{}]interface{}{},
 		},
 		{
-			name: "Missing Timestamp",
+			name: "Invalid Timestamp",
 			input: map[interface{}]interface{}{
 				"_aws": map[interface{}]interface{}{
+					"Timestamp":         "yesterday",
 					"CloudWatchMetrics": []interface{}{},
 				},
 			},
@@ -87,7 +94,7 @@ func TestEmfFromRecord_InvalidInput(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			_, err := EmfFromRecord(tc.input)
+			_, err := EmfFromRecord(tc.input, nil, time.Now(), "", &common.PluginOptions{})
 			if err == nil {
 				t.Error("Expected error, got nil")
 			}
@@ -99,7 +106,7 @@ func TestParseMetricValue(t *testing.T) {
 	expectedMin := 1.0
 	expectedMax := 2.0
 	expectedSum := 3.0
-	expectedCount := uint(2)
+	expectedCount := uint64(2)
 	testCases := []struct {
 		name     string
 		input    interface{}
@@ -124,18 +131,54 @@ func TestParseMetricValue(t *testing.T) {
 			},
 			expected: MetricValue{
 				Values: []float64{1.0, 2.0},
-				Counts: []uint{1, 1},
+				Counts: []uint64{1, 1},
 				Min:    &expectedMin,
 				Max:    &expectedMax,
 				Sum:    &expectedSum,
 				Count:  &expectedCount,
 			},
 		},
+		{
+			name:  "Array value",
+			input: []interface{}{float64(12), int64(15), float64(12)},
+			expected: MetricValue{
+				Values: []float64{12, 15, 12},
+				Counts: []uint64{1, 1, 1},
+			},
+		},
+		{
+			name: "Values without Counts",
+			input: map[interface{}]interface{}{
+				"Values": []interface{}{float64(1.0), float64(2.0)},
+			},
+			expected: MetricValue{
+				Values: []float64{1.0, 2.0},
+				Counts: []uint64{1, 1},
+			},
+		},
+		{
+			name: "Statistic set",
+			input: map[interface{}]interface{}{
+				"Min":   float64(1.0),
+				"Max":   float64(2.0),
+				"Sum":   float64(3.0),
+				"Count": float64(2),
+			},
+			expected: MetricValue{
+				Min:   &expectedMin,
+				Max:   &expectedMax,
+				Sum:   &expectedSum,
+				Count: &expectedCount,
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := parseMetricValue(tc.input)
+			result, err := parseMetricValue(tc.input, false)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
 			if !reflect.DeepEqual(result, tc.expected) {
 				t.Errorf("Expected %+v, got %+v", tc.expected, result)
 			}
@@ -143,6 +186,188 @@ func TestParseMetricValue(t *testing.T) {
 	}
 }
 
+func TestParseMetricValue_InvalidInput(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input interface{}
+	}{
+		{
+			name:  "Non numeric string",
+			input: "abc",
+		},
+		{
+			name:  "Nil value",
+			input: nil,
+		},
+		{
+			name:  "Non numeric array entry",
+			input: []interface{}{float64(1), "abc"},
+		},
+		{
+			name: "Negative count",
+			input: map[interface{}]interface{}{
+				"Values": []interface{}{float64(1.0)},
+				"Counts": []interface{}{int64(-1)},
+			},
+		},
+		{
+			name: "Fractional count",
+			input: map[interface{}]interface{}{
+				"Values": []interface{}{float64(1.0)},
+				"Counts": []interface{}{float64(1.5)},
+			},
+		},
+		{
+			name: "Non numeric Sum",
+			input: map[interface{}]interface{}{
+				"Min": float64(1.0), "Max": float64(2.0), "Sum": "abc", "Count": float64(2),
+			},
+		},
+		{
+			name: "Mismatched lengths",
+			input: map[interface{}]interface{}{
+				"Values": []interface{}{float64(1.0), float64(2.0)},
+				"Counts": []interface{}{float64(1)},
+			},
+		},
+		{
+			name: "Counts without Values",
+			input: map[interface{}]interface{}{
+				"Counts": []interface{}{float64(1)},
+			},
+		},
+		{
+			name: "Values not an array",
+			input: map[interface{}]interface{}{
+				"Values": float64(1.0),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseMetricValue(tc.input, false); err == nil {
+				t.Errorf("Expected error for %v", tc.input)
+			}
+		})
+	}
+}
+
+func TestEmfFromRecord_InvalidMetricValue(t *testing.T) {
+	input := map[interface{}]interface{}{
+		"_aws": map[interface{}]interface{}{
+			"Timestamp": int64(1234567890),
+			"CloudWatchMetrics": []interface{}{
+				map[interface{}]interface{}{
+					"Namespace":  "TestNamespace",
+					"Dimensions": []interface{}{},
+					"Metrics": []interface{}{
+						map[interface{}]interface{}{"Name": "TestMetric"},
+					},
+				},
+			},
+		},
+		"TestMetric": map[interface{}]interface{}{
+			"Values": []interface{}{float64(1.0)},
+			"Counts": []interface{}{float64(1), float64(2)},
+		},
+	}
+
+	if _, err := EmfFromRecord(input, nil, time.Now(), "", &common.PluginOptions{}); err == nil {
+		t.Error("Expected error for mismatched Values and Counts")
+	}
+}
+
+func TestEmfFromRecord_InvalidValues(t *testing.T) {
+	for _, bad := range []interface{}{"not a number", "NaN", "+Infinity", []interface{}{1.5, "Inf"}} {
+		input := map[interface{}]interface{}{
+			"_aws": map[interface{}]interface{}{
+				"Timestamp": int64(1234567890),
+				"CloudWatchMetrics": []interface{}{
+					map[interface{}]interface{}{
+						"Namespace":  "TestNamespace",
+						"Dimensions": []interface{}{},
+						"Metrics": []interface{}{
+							map[interface{}]interface{}{"Name": "Good"},
+							map[interface{}]interface{}{"Name": "Bad"},
+						},
+					},
+				},
+			},
+			"Good": uint64(5),
+			"Bad":  bad,
+		}
+
+		if _, err := EmfFromRecord(input, nil, time.Now(), "", &common.PluginOptions{InvalidValues: common.InvalidValuesDropRecord}); err == nil {
+			t.Errorf("Expected the record with %#v to be rejected", bad)
+		}
+
+		emf, err := EmfFromRecord(input, nil, time.Now(), "", &common.PluginOptions{InvalidValues: common.InvalidValuesDropMetric})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, exists := emf.MetricData["Bad"]; exists {
+			t.Errorf("Expected the metric with %#v to be dropped", bad)
+		}
+		if value := emf.MetricData["Good"].Value; value == nil || *value != 5 {
+			t.Errorf("Expected the good metric to be kept as 5, got %v", value)
+		}
+		expected := []common.MetricDefinition{{Name: "Good"}}
+		if len(emf.AWS.CloudWatchMetrics) != 1 || !reflect.DeepEqual(emf.AWS.CloudWatchMetrics[0].Metrics, expected) {
+			t.Errorf("Expected only the good metric to stay declared, got %+v", emf.AWS.CloudWatchMetrics)
+		}
+
+		onlyBad := map[interface{}]interface{}{
+			"_aws": map[interface{}]interface{}{
+				"CloudWatchMetrics": []interface{}{
+					map[interface{}]interface{}{
+						"Namespace":  "TestNamespace",
+						"Dimensions": []interface{}{},
+						"Metrics":    []interface{}{map[interface{}]interface{}{"Name": "Bad"}},
+					},
+				},
+			},
+			"Bad": bad,
+		}
+		if _, err := EmfFromRecord(onlyBad, nil, time.Now(), "", &common.PluginOptions{InvalidValues: common.InvalidValuesDropMetric}); err == nil {
+			t.Errorf("Expected the record with only %#v to be rejected", bad)
+		}
+
+		emf, err = EmfFromRecord(input, nil, time.Now(), "", &common.PluginOptions{InvalidValues: common.InvalidValuesCoerce})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if value := emf.MetricData["Bad"]; (value.Value == nil || *value.Value != 0) && (len(value.Values) != 2 || value.Values[1] != 0) {
+			t.Errorf("Expected %#v to be coerced to 0, got %+v", bad, value)
+		}
+	}
+}
+
+func TestAddDimension(t *testing.T) {
+	emf := &EMFMetric{
+		AWS: &common.AWSMetadata{CloudWatchMetrics: []common.ProjectionDefinition{
+			{Namespace: "A", Dimensions: [][]string{{"Service"}, {}}},
+			{Namespace: "B"},
+		}},
+		DimensionSet: map[string]bool{"Service": true},
+		Dimensions:   map[string]string{"Service": "api"},
+	}
+
+	emf.AddDimension("Tag", "app.web")
+	emf.AddDimension("Service", "ignored")
+
+	expected := []common.ProjectionDefinition{
+		{Namespace: "A", Dimensions: [][]string{{"Service", "Tag"}, {"Tag"}}},
+		{Namespace: "B", Dimensions: [][]string{{"Tag"}}},
+	}
+	if !reflect.DeepEqual(emf.AWS.CloudWatchMetrics, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, emf.AWS.CloudWatchMetrics)
+	}
+	if emf.Dimensions["Tag"] != "app.web" || emf.Dimensions["Service"] != "api" {
+		t.Errorf("Expected the tag to be added without overriding Service, got %v", emf.Dimensions)
+	}
+}
+
 func TestToString(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -180,3 +405,326 @@ func TestToString(t *testing.T) {
 func float64Ptr(v float64) *float64 {
 	return &v
 }
+
+func TestEmfFromRecord_DimensionRules(t *testing.T) {
+	rules, err := dimension.ParseRules("Operation lower; Operation allow get,put")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	options := &common.PluginOptions{DimensionRules: rules}
+	for operation, expected := range map[string]string{"GET": "get", "Delete": dimension.DefaultBucket} {
+		emf, err := EmfFromRecord(rollupRecord(operation, 1), nil, time.Now(), "", options)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if emf.Dimensions["Operation"] != expected || emf.Dimensions["Service"] != "api" {
+			t.Errorf("Expected Operation %s, got %v", expected, emf.Dimensions)
+		}
+	}
+}
+
+func TestInjectDimension(t *testing.T) {
+	for _, tc := range []struct {
+		placement string
+		target    string
+		expected  [][]string
+	}{
+		{placement: dimension.PlacementAppend, expected: [][]string{{"Cluster", "Service"}, {"Cluster", "Operation", "Service"}}},
+		{placement: dimension.PlacementAppend, target: "Operation", expected: [][]string{{"Service"}, {"Cluster", "Operation", "Service"}}},
+		{placement: dimension.PlacementAppend, target: "Missing", expected: [][]string{{"Service"}, {"Operation", "Service"}}},
+		{placement: dimension.PlacementSet, expected: [][]string{{"Service"}, {"Operation", "Service"}, {"Cluster"}}},
+	} {
+		emf, err := EmfFromRecord(rollupRecord("Get", 1), nil, time.Now(), "", &common.PluginOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		emf.InjectDimension("Cluster", "prod", tc.placement, tc.target)
+
+		if dims := emf.AWS.CloudWatchMetrics[0].Dimensions; !reflect.DeepEqual(dims, tc.expected) {
+			t.Errorf("%s:%s: expected %v, got %v", tc.placement, tc.target, tc.expected, dims)
+		}
+		if _, injected := emf.Dimensions["Cluster"]; injected != (tc.target != "Missing") {
+			t.Errorf("%s:%s: expected the value only when a set references it, got %v", tc.placement, tc.target, emf.Dimensions)
+		}
+	}
+
+	// metrics without dimensions keep being published without them next to the new set
+	emf, err := EmfFromRecord(rollupRecord("Get", 1), nil, time.Now(), "", &common.PluginOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	emf.AWS.CloudWatchMetrics[0].Dimensions = nil
+	emf.InjectDimension("Cluster", "prod", dimension.PlacementSet, "")
+	if dims := emf.AWS.CloudWatchMetrics[0].Dimensions; !reflect.DeepEqual(dims, [][]string{{}, {"Cluster"}}) {
+		t.Errorf("Expected an empty set and the new one, got %v", dims)
+	}
+}
+
+func TestEmfFromRecord_InjectedDimensions(t *testing.T) {
+	injections, err := dimension.ParseInjections("Pod field:kubernetes.pod; Owner field:owner; Cluster value:Prod")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rules, err := dimension.ParseRules("Cluster lower")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	validation, err := ParseValidation("")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	options := &common.PluginOptions{
+		TagDimension:        "Tag",
+		DimensionInjections: injections,
+		DimensionRules:      rules,
+		DropDimensions:      []string{"Tag", "Pod"},
+		Validation:          validation,
+	}
+	record := rollupRecord("Get", 1)
+	record["kubernetes"] = map[interface{}]interface{}{"pod": "web-1"}
+	record["owner"] = strings.Repeat("o", 5000)
+
+	emf, err := EmfFromRecord(record, nil, time.Now(), "app.web", options)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, name := range []string{"Tag", "Pod"} {
+		if _, injected := emf.Dimensions[name]; injected || emf.DimensionSet[name] {
+			t.Errorf("Expected the dropped %s not to be injected, got %v", name, emf.Dimensions)
+		}
+	}
+	for _, dimSet := range emf.AWS.CloudWatchMetrics[0].Dimensions {
+		if utils.Find(dimSet, func(d string) bool { return d == "Tag" || d == "Pod" }) != -1 {
+			t.Errorf("Expected no set with a dropped dimension, got %v", emf.AWS.CloudWatchMetrics[0].Dimensions)
+		}
+	}
+	if cluster := emf.Dimensions["Cluster"]; cluster != "prod" {
+		t.Errorf("Expected the injected Cluster to be rewritten to prod, got %q", cluster)
+	}
+	if owner := emf.Dimensions["Owner"]; len(owner) != 1024 {
+		t.Errorf("Expected the injected Owner to be cut to 1024 characters, got %d", len(owner))
+	}
+}
+
+func TestEmfFromRecord_MetadataInjection(t *testing.T) {
+	injections, err := dimension.ParseInjections("App metadata:otel.service; Scope metadata:otel.scope")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	options := &common.PluginOptions{DimensionInjections: injections}
+
+	// a hand written fluent-bit 2.x+ chunk, [[timestamp, metadata], record]
+	fixarray := func(n int) []byte { return []byte{0x90 | byte(n)} }
+	fixmap := func(n int) []byte { return []byte{0x80 | byte(n)} }
+	str := func(s string) []byte { return append([]byte{0xa0 | byte(len(s))}, s...) }
+	var chunk []byte
+	for _, part := range [][]byte{
+		fixarray(2), fixarray(2), {0xce, 0x65, 0x53, 0xf1, 0x00},
+		fixmap(1), str("otel"), fixmap(1), str("service"), str("checkout"),
+		fixmap(2), str("_aws"), fixmap(1), str("CloudWatchMetrics"), fixarray(1), fixmap(3),
+		str("Namespace"), str("NS"), str("Dimensions"), fixarray(1), fixarray(0),
+		str("Metrics"), fixarray(1), fixmap(1), str("Name"), str("Latency"),
+		str("Latency"), {0x01},
+	} {
+		chunk = append(chunk, part...)
+	}
+	event, err := decoder.NewDecoder(chunk).Next()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	emf, err := EmfFromRecord(event.Record, event.Metadata, event.Time, "", options)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if service := emf.Dimensions["App"]; service != "checkout" {
+		t.Errorf("Expected App to be injected from the metadata, got %v", emf.Dimensions)
+	}
+	if _, injected := emf.Dimensions["Scope"]; injected {
+		t.Errorf("Expected no dimension for metadata the event doesn't have, got %v", emf.Dimensions)
+	}
+	if dims := emf.AWS.CloudWatchMetrics[0].Dimensions; !reflect.DeepEqual(dims, [][]string{{"App"}}) {
+		t.Errorf("Expected App in the dimension set, got %v", dims)
+	}
+
+	// the record itself isn't looked at
+	record := rollupRecord("Get", 1)
+	record["otel"] = map[interface{}]interface{}{"service": "checkout"}
+	if emf, err = EmfFromRecord(record, nil, time.Now(), "", options); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, injected := emf.Dimensions["App"]; injected {
+		t.Errorf("Expected no App without metadata, got %v", emf.Dimensions)
+	}
+}
+
+func TestDropDimensions(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		patterns   []string
+		dimensions [][]string
+		expected   [][]string
+		// every set was dropped, so the directive is
+		dropped bool
+	}{
+		{name: "no patterns", dimensions: [][]string{{"Client", "Service"}}, expected: [][]string{{"Client", "Service"}}},
+		{name: "every set", patterns: []string{"Client"}, dimensions: [][]string{{"Client", "Service"}, {"Client", "Operation"}}, expected: [][]string{{"Service"}, {"Operation"}}},
+		{name: "duplicate", patterns: []string{"Client"}, dimensions: [][]string{{"Service"}, {"Client", "Service"}}, expected: [][]string{{"Service"}}},
+		{name: "empty", patterns: []string{"Client"}, dimensions: [][]string{{"Client"}, {"Service"}}, expected: [][]string{{"Service"}}},
+		{name: "explicitly empty", patterns: []string{"Client"}, dimensions: [][]string{{}, {"Client"}}, expected: [][]string{{}}},
+		{name: "glob", patterns: []string{"Client*"}, dimensions: [][]string{{"ClientId", "ClientVersion", "Service"}}, expected: [][]string{{"Service"}}},
+		{name: "all", patterns: []string{"*"}, dimensions: [][]string{{"Client"}, {"Service"}}, dropped: true},
+		{name: "no sets", patterns: []string{"*"}, dimensions: [][]string{}, expected: [][]string{}},
+	} {
+		def := common.ProjectionDefinition{Namespace: "NS", Dimensions: tc.dimensions, Metrics: []common.MetricDefinition{{Name: "Latency"}}}
+		if kept := dropDimensions(&def, tc.patterns); kept == tc.dropped {
+			t.Errorf("%s: expected the directive to be dropped %v", tc.name, tc.dropped)
+		} else if kept && !reflect.DeepEqual(def.Dimensions, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, def.Dimensions)
+		}
+	}
+}
+
+func TestAggregateMetric_DropDimensions(t *testing.T) {
+	options := &common.PluginOptions{DropDimensions: []string{"Operation"}}
+	a := newTestAggregator(options)
+	for i, operation := range []string{"Get", "Put", "List"} {
+		emf, err := EmfFromRecord(rollupRecord(operation, float64(i)), nil, time.Now(), "", options)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, kept := emf.Dimensions["Operation"]; kept {
+			t.Errorf("Expected Operation to be dropped, got %v", emf.Dimensions)
+		}
+		a.AggregateMetric(emf)
+	}
+
+	if len(a.metrics) != 1 {
+		t.Errorf("Expected the operations to merge into one series, got %d", len(a.metrics))
+	}
+	for _, metadata := range a.metadataStore {
+		if dims := metadata.AWS.CloudWatchMetrics[0].Dimensions; !reflect.DeepEqual(dims, [][]string{{"Service"}}) {
+			t.Errorf("Expected only the Service set, got %v", dims)
+		}
+	}
+}
+
+func TestEmfFromRecord_DropEveryDimension(t *testing.T) {
+	record := rollupRecord("Get", 1)
+	aws := record["_aws"].(map[interface{}]interface{})
+	aws["CloudWatchMetrics"] = append(aws["CloudWatchMetrics"].([]interface{}), map[interface{}]interface{}{
+		"Namespace":  "Totals",
+		"Dimensions": []interface{}{[]interface{}{}},
+		"Metrics":    []interface{}{map[interface{}]interface{}{"Name": "Latency"}},
+	})
+
+	// the directive with only dropped dimensions goes, the one explicitly without dimensions stays
+	emf, err := EmfFromRecord(record, nil, time.Now(), "", &common.PluginOptions{DropDimensions: []string{"Service", "Operation"}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if directives := emf.AWS.CloudWatchMetrics; len(directives) != 1 || directives[0].Namespace != "Totals" || len(emf.Dimensions) != 0 {
+		t.Errorf("Expected only the Totals directive, got %v with %v", directives, emf.Dimensions)
+	}
+	if len(emf.Diagnostics) != 1 || emf.Diagnostics[0].Reason != ReasonNoDimensions {
+		t.Errorf("Expected the dropped directive to be reported, got %v", emf.Diagnostics)
+	}
+
+	// without any directive left the record has nothing to publish
+	if _, err := EmfFromRecord(rollupRecord("Get", 1), nil, time.Now(), "", &common.PluginOptions{DropDimensions: []string{"*"}}); err == nil {
+		t.Error("Expected a record with every dimension dropped to be rejected")
+	}
+}
+
+func TestEmfFromRecord_MetricRules(t *testing.T) {
+	rules, err := metric.ParseRules("* Debug* drop; * Latency namespace {namespace}/Latency; * Faults rename Errors")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	record := rollupRecord("Get", 12)
+	directive := record["_aws"].(map[interface{}]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[interface{}]interface{})
+	directive["Metrics"] = []interface{}{
+		map[interface{}]interface{}{"Name": "Latency", "Unit": "Milliseconds"},
+		map[interface{}]interface{}{"Name": "DebugCounter"},
+		map[interface{}]interface{}{"Name": "Errors"},
+		map[interface{}]interface{}{"Name": "Faults"},
+	}
+	record["DebugCounter"] = float64(1)
+	record["Errors"] = float64(2)
+	record["Faults"] = float64(3)
+
+	emf, err := EmfFromRecord(record, nil, time.Now(), "", &common.PluginOptions{MetricRules: rules})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	dimensions := [][]string{{"Service"}, {"Operation", "Service"}}
+	expected := []common.ProjectionDefinition{
+		{Namespace: "TestNamespace/Latency", Dimensions: dimensions, Metrics: []common.MetricDefinition{{Name: "Latency", Unit: "Milliseconds"}}},
+		{Namespace: "TestNamespace", Dimensions: dimensions, Metrics: []common.MetricDefinition{{Name: "Errors"}}},
+	}
+	if !reflect.DeepEqual(emf.AWS.CloudWatchMetrics, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, emf.AWS.CloudWatchMetrics)
+	}
+	if len(emf.MetricData) != 2 || *emf.MetricData["Latency"].Value != 12 || *emf.MetricData["Errors"].Value != 2 {
+		t.Errorf("Expected the Latency and Errors values, got %+v", emf.MetricData)
+	}
+	if len(emf.Diagnostics) != 1 || emf.Diagnostics[0].Reason != ReasonNameConflict {
+		t.Errorf("Expected the rename onto Errors to be reported, got %v", emf.Diagnostics)
+	}
+
+	// whatever the declaration order, the record's own metric and the first rename win
+	rules, err = metric.ParseRules("* Faults rename Errors; * Failures rename Errors")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, order := range [][]string{{"Faults", "Failures", "Errors"}, {"Errors", "Faults", "Failures"}} {
+		record = rollupRecord("Get", 12)
+		directive = record["_aws"].(map[interface{}]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[interface{}]interface{})
+		metrics := make([]interface{}, len(order))
+		for i, name := range order {
+			metrics[i] = map[interface{}]interface{}{"Name": name}
+			record[name] = float64(len(name))
+		}
+		directive["Metrics"] = metrics
+		emf, err = EmfFromRecord(record, nil, time.Now(), "", &common.PluginOptions{MetricRules: rules})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if value := emf.MetricData["Errors"].Value; len(emf.MetricData) != 1 || value == nil || *value != float64(len("Errors")) {
+			t.Errorf("%v: expected only the record's own Errors, got %+v", order, emf.MetricData)
+		}
+		if len(emf.Diagnostics) != 2 {
+			t.Errorf("%v: expected both renames to be reported, got %v", order, emf.Diagnostics)
+		}
+	}
+	for _, order := range [][]string{{"Faults", "Failures"}, {"Failures", "Faults"}} {
+		record = rollupRecord("Get", 12)
+		directive = record["_aws"].(map[interface{}]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[interface{}]interface{})
+		directive["Metrics"] = []interface{}{map[interface{}]interface{}{"Name": order[0]}, map[interface{}]interface{}{"Name": order[1]}}
+		record[order[0]], record[order[1]] = float64(1), float64(2)
+		emf, err = EmfFromRecord(record, nil, time.Now(), "", &common.PluginOptions{MetricRules: rules})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if value := emf.MetricData["Errors"].Value; len(emf.MetricData) != 1 || value == nil || *value != 1 {
+			t.Errorf("%v: expected the first declared rename to win, got %+v", order, emf.MetricData)
+		}
+	}
+
+	// records left without metrics aren't aggregated
+	dropAll, err := metric.ParseRules("* * drop")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	options := &common.PluginOptions{MetricRules: dropAll}
+	emf, err = EmfFromRecord(rollupRecord("Get", 1), nil, time.Now(), "", options)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	a := newTestAggregator(options)
+	a.AggregateMetric(emf)
+	if len(emf.AWS.CloudWatchMetrics) != 0 || len(a.metrics) != 0 {
+		t.Errorf("Expected every metric to be dropped, got %+v and %d series", emf.AWS.CloudWatchMetrics, len(a.metrics))
+	}
+}
@@ -0,0 +1,109 @@
+package emf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// maxDistinctValues caps the values kept for a distinct property, it's meant for low cardinality
+// properties and anything more is dropped rather than growing the event without limit
+const maxDistinctValues = 100
+
+// ParseRetainedProperties parses `property [policy]; ...` where policy is key, last or distinct,
+// last when it's left out
+func ParseRetainedProperties(config string) (map[string]string, error) {
+	properties := make(map[string]string)
+	for _, rule := range strings.Split(config, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("expected property [policy], was %q", strings.TrimSpace(rule))
+		}
+		policy := common.RetainLast
+		if len(fields) == 2 {
+			policy = strings.ToLower(fields[1])
+		}
+		switch policy {
+		case common.RetainKey, common.RetainLast, common.RetainDistinct:
+		default:
+			return nil, fmt.Errorf("unknown policy %q for %s, expected key, last or distinct", policy, fields[0])
+		}
+		properties[fields[0]] = policy
+	}
+	return properties, nil
+}
+
+// retainedProperties are the properties of a series kept for its output event
+type retainedProperties struct {
+	values   map[string]interface{}
+	distinct map[string][]interface{}
+	seen     map[string]map[string]bool
+}
+
+func newRetainedProperties() *retainedProperties {
+	return &retainedProperties{
+		values:   make(map[string]interface{}),
+		distinct: make(map[string][]interface{}),
+		seen:     make(map[string]map[string]bool),
+	}
+}
+
+// add keeps the properties of a record aggregated into the series
+func (r *retainedProperties) add(emf *EMFMetric, policies map[string]string) {
+	for name, value := range emf.KeyProperties {
+		r.values[name] = value
+	}
+	for name, value := range emf.Properties {
+		if policies[name] != common.RetainDistinct {
+			r.values[name] = value
+			continue
+		}
+		if r.seen[name] == nil {
+			r.seen[name] = make(map[string]bool)
+		}
+		// compared by their printed form so maps and arrays can be values too, fmt sorts map keys
+		key := fmt.Sprintf("%#v", value)
+		if r.seen[name][key] || len(r.distinct[name]) >= maxDistinctValues {
+			continue
+		}
+		r.seen[name][key] = true
+		r.distinct[name] = append(r.distinct[name], value)
+	}
+}
+
+// fields adds the properties to an output event, never replacing a metric or dimension
+func (r *retainedProperties) fields(fields map[string]interface{}) {
+	for name, value := range r.values {
+		if _, exists := fields[name]; !exists {
+			fields[name] = value
+		}
+	}
+	for name, values := range r.distinct {
+		if _, exists := fields[name]; !exists {
+			fields[name] = values
+		}
+	}
+}
+
+// retainProperty keeps a record property that isn't a metric or dimension if it's configured
+func (emf *EMFMetric) retainProperty(name string, value interface{}, policies map[string]string) {
+	switch policies[name] {
+	case "":
+		return
+	case common.RetainKey:
+		if emf.KeyProperties == nil {
+			emf.KeyProperties = make(map[string]string)
+		}
+		emf.KeyProperties[name] = utils.ToString(value)
+	default:
+		if emf.Properties == nil {
+			emf.Properties = make(map[string]interface{})
+		}
+		emf.Properties[name] = utils.ToJSONValue(value)
+	}
+}
@@ -0,0 +1,85 @@
+package emf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+func TestParseRetainedProperties(t *testing.T) {
+	properties, err := ParseRetainedProperties("ServiceVersion; DeploymentId DISTINCT ;Region key;")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := map[string]string{
+		"ServiceVersion": common.RetainLast,
+		"DeploymentId":   common.RetainDistinct,
+		"Region":         common.RetainKey,
+	}
+	if !reflect.DeepEqual(properties, expected) {
+		t.Errorf("Expected %v, got %v", expected, properties)
+	}
+
+	for _, invalid := range []string{"Region first", "Region key extra"} {
+		if _, err := ParseRetainedProperties(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestAggregateMetric_RetainedProperties(t *testing.T) {
+	options := &common.PluginOptions{RetainedProperties: map[string]string{
+		"ServiceVersion": common.RetainLast,
+		"DeploymentId":   common.RetainDistinct,
+		"Region":         common.RetainKey,
+		"Service":        common.RetainLast,
+	}}
+	a := newTestAggregator(options)
+	for i, properties := range []map[string]interface{}{
+		{"ServiceVersion": "1.0", "DeploymentId": []byte("d-1"), "Region": "us-east-1"},
+		{"ServiceVersion": "1.1", "DeploymentId": "d-2", "Region": "us-east-1"},
+		{"ServiceVersion": "1.1", "DeploymentId": "d-1", "Region": "us-east-1"},
+		{"ServiceVersion": "2.0", "DeploymentId": "d-3", "Region": "eu-west-1", "Ignored": "x"},
+	} {
+		record := unitRecord("Milliseconds", float64(i))
+		for name, value := range properties {
+			record[name] = value
+		}
+		emf, err := EmfFromRecord(record, nil, time.Now(), "", options)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		a.AggregateMetric(emf)
+	}
+
+	if len(a.metadataStore) != 2 {
+		t.Fatalf("Expected a series per Region, got %d", len(a.metadataStore))
+	}
+	for _, metadata := range a.metadataStore {
+		fields := map[string]interface{}{"Service": "api"}
+		metadata.Properties.fields(fields)
+
+		expected := map[string]interface{}{
+			"Service":        "api",
+			"ServiceVersion": "1.1",
+			"DeploymentId":   []interface{}{"d-1", "d-2"},
+			"Region":         "us-east-1",
+		}
+		if fields["Region"] == "eu-west-1" {
+			expected = map[string]interface{}{
+				"Service":        "api",
+				"ServiceVersion": "2.0",
+				"DeploymentId":   []interface{}{"d-3"},
+				"Region":         "eu-west-1",
+			}
+		}
+		if !reflect.DeepEqual(fields, expected) {
+			t.Errorf("Expected %v, got %v", expected, fields)
+		}
+		if dims := metadata.AWS.CloudWatchMetrics[0].Dimensions; !reflect.DeepEqual(dims, [][]string{{"Service"}}) {
+			t.Errorf("Expected properties to stay out of the dimensions, got %v", dims)
+		}
+	}
+}
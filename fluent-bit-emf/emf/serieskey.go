@@ -0,0 +1,153 @@
+package emf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// seriesKeys builds the key identifying which series a record is aggregated into: the tag when
+// it's part of the identity, each directive's namespace and dimension sets, the dimension
+// name/value pairs, the retained properties that are part of the key and the unit of a part split
+// off for a unit conflict. Every string is length prefixed so no value can be mistaken for a separator,
+// and the buffers are reused so looking up an existing series doesn't allocate
+type seriesKeys struct {
+	buf        []byte
+	scratch    []byte
+	sets       []span
+	directives []span
+	names      []string
+	interned   map[string]string
+}
+
+// span is an encoded part of the scratch buffer
+type span struct {
+	start, end int
+}
+
+func newSeriesKeys() *seriesKeys {
+	return &seriesKeys{interned: make(map[string]string)}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// sortSpans insertion sorts the encoded parts, there are only ever a few of them
+func sortSpans(b []byte, spans []span) {
+	for i := 1; i < len(spans); i++ {
+		for j := i; j > 0 && bytes.Compare(b[spans[j].start:spans[j].end], b[spans[j-1].start:spans[j-1].end]) < 0; j-- {
+			spans[j], spans[j-1] = spans[j-1], spans[j]
+		}
+	}
+}
+
+// build returns the key for the record, only valid until the next call. Index maps with
+// m[string(key)], which doesn't allocate, and intern the key before storing it
+func (k *seriesKeys) build(emf *EMFMetric, includeTag bool) []byte {
+	b := k.buf[:0]
+	if includeTag {
+		b = append(b, 1)
+		b = appendString(b, emf.Tag)
+	} else {
+		b = append(b, 0)
+	}
+
+	// directives and their dimension sets in a canonical order, so the same declarations in a
+	// different order match
+	scratch := k.scratch[:0]
+	k.directives = k.directives[:0]
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		k.sets = k.sets[:0]
+		for _, dimSet := range def.Dimensions {
+			start := len(scratch)
+			scratch = binary.AppendUvarint(scratch, uint64(len(dimSet)))
+			for _, name := range dimSet {
+				scratch = appendString(scratch, name)
+			}
+			k.sets = append(k.sets, span{start, len(scratch)})
+		}
+		sortSpans(scratch, k.sets)
+
+		start := len(scratch)
+		scratch = appendString(scratch, def.Namespace)
+		scratch = binary.AppendUvarint(scratch, uint64(len(k.sets)))
+		for _, set := range k.sets {
+			scratch = append(scratch, scratch[set.start:set.end]...)
+		}
+		k.directives = append(k.directives, span{start, len(scratch)})
+	}
+	sortSpans(scratch, k.directives)
+	b = binary.AppendUvarint(b, uint64(len(k.directives)))
+	for _, directive := range k.directives {
+		b = append(b, scratch[directive.start:directive.end]...)
+	}
+	k.scratch = scratch
+
+	k.names = k.names[:0]
+	for name := range emf.Dimensions {
+		k.names = append(k.names, name)
+	}
+	sort.Strings(k.names)
+	b = binary.AppendUvarint(b, uint64(len(k.names)))
+	for _, name := range k.names {
+		b = appendString(b, name)
+		b = appendString(b, emf.Dimensions[name])
+	}
+
+	k.names = k.names[:0]
+	for name := range emf.KeyProperties {
+		k.names = append(k.names, name)
+	}
+	sort.Strings(k.names)
+	b = binary.AppendUvarint(b, uint64(len(k.names)))
+	for _, name := range k.names {
+		b = appendString(b, name)
+		b = appendString(b, emf.KeyProperties[name])
+	}
+	// a part split off without a unit still needs a key of its own
+	if emf.Split {
+		b = append(b, 1)
+		b = appendString(b, emf.SplitUnit)
+	} else {
+		b = append(b, 0)
+	}
+
+	k.buf = b
+	return b
+}
+
+// intern returns a shared copy of s, so the keys and dimensions of every series in a period
+// are only stored once
+func (k *seriesKeys) intern(s string) string {
+	if interned, exists := k.interned[s]; exists {
+		return interned
+	}
+	k.interned[s] = s
+	return s
+}
+
+// internBytes is intern for a key from build, only allocating the first time it's seen
+func (k *seriesKeys) internBytes(b []byte) string {
+	if interned, exists := k.interned[string(b)]; exists {
+		return interned
+	}
+	s := string(b)
+	k.interned[s] = s
+	return s
+}
+
+// internDimensions returns the dimensions with interned names and values
+func (k *seriesKeys) internDimensions(dimensions map[string]string) map[string]string {
+	interned := make(map[string]string, len(dimensions))
+	for name, value := range dimensions {
+		interned[k.intern(name)] = k.intern(value)
+	}
+	return interned
+}
+
+// reset drops everything interned once the series it was for have been flushed
+func (k *seriesKeys) reset() {
+	k.interned = make(map[string]string)
+}
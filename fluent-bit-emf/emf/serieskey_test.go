@@ -0,0 +1,115 @@
+package emf
+
+import (
+	"testing"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+func seriesMetric(namespace string, dimensions [][]string, values map[string]string) *EMFMetric {
+	return &EMFMetric{
+		AWS: &common.AWSMetadata{
+			CloudWatchMetrics: []common.ProjectionDefinition{
+				{Namespace: namespace, Dimensions: dimensions, Metrics: []common.MetricDefinition{{Name: "Latency"}}},
+			},
+		},
+		Dimensions: values,
+	}
+}
+
+func TestSeriesKeys_Build(t *testing.T) {
+	service := [][]string{{"A", "B"}}
+	for _, tc := range []struct {
+		name  string
+		a, b  *EMFMetric
+		equal bool
+	}{
+		{
+			name:  "same series",
+			a:     seriesMetric("NS", service, map[string]string{"A": "1", "B": "2"}),
+			b:     seriesMetric("NS", service, map[string]string{"B": "2", "A": "1"}),
+			equal: true,
+		},
+		{
+			name: "separator in a value",
+			a:    seriesMetric("NS", service, map[string]string{"A": "1;B=2", "B": ""}),
+			b:    seriesMetric("NS", service, map[string]string{"A": "1", "B": "2;B="}),
+		},
+		{
+			name: "equals in a name",
+			a:    seriesMetric("NS", [][]string{{"A=1"}}, map[string]string{"A=1": "x"}),
+			b:    seriesMetric("NS", [][]string{{"A"}}, map[string]string{"A": "1=x"}),
+		},
+		{
+			name: "namespace",
+			a:    seriesMetric("NS", service, map[string]string{"A": "1", "B": "2"}),
+			b:    seriesMetric("Other", service, map[string]string{"A": "1", "B": "2"}),
+		},
+		{
+			name: "dimension sets",
+			a:    seriesMetric("NS", service, map[string]string{"A": "1", "B": "2"}),
+			b:    seriesMetric("NS", [][]string{{"A"}, {"A", "B"}}, map[string]string{"A": "1", "B": "2"}),
+		},
+		{
+			name:  "dimension set order",
+			a:     seriesMetric("NS", [][]string{{"A"}, {"A", "B"}}, map[string]string{"A": "1", "B": "2"}),
+			b:     seriesMetric("NS", [][]string{{"A", "B"}, {"A"}}, map[string]string{"A": "1", "B": "2"}),
+			equal: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := newSeriesKeys()
+			a := string(keys.build(tc.a, false))
+			b := string(keys.build(tc.b, false))
+			if (a == b) != tc.equal {
+				t.Errorf("Expected equal keys %v, got %q and %q", tc.equal, a, b)
+			}
+		})
+	}
+}
+
+func TestSeriesKeys_Tag(t *testing.T) {
+	keys := newSeriesKeys()
+	a := seriesMetric("NS", nil, map[string]string{})
+	a.Tag = "app.a"
+	b := seriesMetric("NS", nil, map[string]string{})
+	b.Tag = "app.b"
+
+	untaggedA := string(keys.build(a, false))
+	untaggedB := string(keys.build(b, false))
+	if untaggedA != untaggedB {
+		t.Errorf("Expected the tag to be ignored unless it's part of the key")
+	}
+	taggedA := string(keys.build(a, true))
+	taggedB := string(keys.build(b, true))
+	if taggedA == taggedB {
+		t.Errorf("Expected different tags to have different keys")
+	}
+}
+
+func TestSeriesKeys_Intern(t *testing.T) {
+	keys := newSeriesKeys()
+	emf := seriesMetric("NS", [][]string{{"Service"}}, map[string]string{"Service": "api"})
+	stored := map[string]bool{keys.internBytes(keys.build(emf, false)): true}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = stored[string(keys.build(emf, false))]
+		keys.internBytes(keys.build(emf, false))
+	})
+	if allocs > 2 {
+		t.Errorf("Expected looking up an existing series to barely allocate, got %v allocations", allocs)
+	}
+
+	first := keys.internDimensions(map[string]string{"Service": "api"})
+	second := keys.internDimensions(map[string]string{"Service": "api"})
+	if first["Service"] != second["Service"] {
+		t.Errorf("Expected interned dimensions to be equal, got %v and %v", first, second)
+	}
+	if len(keys.interned) != 3 {
+		t.Errorf("Expected the key, name and value to be interned, got %d", len(keys.interned))
+	}
+	keys.reset()
+	if len(keys.interned) != 0 {
+		t.Errorf("Expected reset to drop interned strings, got %d", len(keys.interned))
+	}
+}
@@ -0,0 +1,114 @@
+package emf
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// ISO-8601 forms seen in the wild beyond RFC 3339, tried in order
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// parseTimestamp returns the timestamp in epoch milliseconds. Numbers and numeric strings are
+// read in the given unit, with TimestampUnitAuto guessing it from the magnitude, and any other
+// string is parsed as an ISO-8601 date, assuming UTC when it has no zone
+func parseTimestamp(value interface{}, unit string) (int64, error) {
+	if s, ok := value.([]byte); ok {
+		value = string(s)
+	}
+	if s, ok := value.(string); ok {
+		if _, err := utils.ParseFloat64(s); err != nil {
+			for _, layout := range timestampLayouts {
+				if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+					return t.UnixMilli(), nil
+				}
+			}
+			return 0, fmt.Errorf("timestamp %q is neither a number nor an ISO-8601 date", s)
+		}
+	}
+	if _, ok := value.(bool); ok {
+		return 0, fmt.Errorf("timestamp was a boolean")
+	}
+
+	// integers are scaled without going through float64 so milliseconds stay exact
+	if i, err := utils.ParseUint64(value); err == nil && i <= math.MaxInt64 {
+		if ms, ok := scaleTimestamp(int64(i), millisecondsIn(float64(i), unit)); ok {
+			return ms, nil
+		}
+	}
+	f, err := utils.ParseFloat64(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("timestamp %v is not finite", f)
+	}
+	ms := millisecondsIn(f, unit) * f
+	if ms < math.MinInt64 || ms >= math.MaxInt64 {
+		return 0, fmt.Errorf("timestamp %v is out of range", f)
+	}
+	return int64(math.Round(ms)), nil
+}
+
+// scaleTimestamp returns false if a non negative timestamp overflows once scaled
+func scaleTimestamp(timestamp int64, multiplier float64) (int64, bool) {
+	if multiplier < 1 {
+		return timestamp / int64(math.Round(1/multiplier)), true
+	}
+	if timestamp > math.MaxInt64/int64(multiplier) {
+		return 0, false
+	}
+	return timestamp * int64(multiplier), true
+}
+
+// millisecondsIn returns how many milliseconds one unit of the timestamp is, guessing the
+// unit from the magnitude for TimestampUnitAuto: epoch seconds stay below 1e11 until the
+// year 5138 while epoch milliseconds passed it in 1973, and likewise for the smaller units
+func millisecondsIn(timestamp float64, unit string) float64 {
+	switch unit {
+	case common.TimestampUnitSeconds:
+		return 1e3
+	case common.TimestampUnitMilliseconds:
+		return 1
+	case common.TimestampUnitMicroseconds:
+		return 1e-3
+	case common.TimestampUnitNanoseconds:
+		return 1e-6
+	}
+	switch abs := math.Abs(timestamp); {
+	case abs < 1e11:
+		return 1e3
+	case abs < 1e14:
+		return 1
+	case abs < 1e17:
+		return 1e-3
+	default:
+		return 1e-6
+	}
+}
+
+// clampTimestamp moves a timestamp outside [now - maxPast, now + maxFuture] to the nearest
+// bound, a zero duration leaves that side unbounded
+func clampTimestamp(timestamp int64, now time.Time, maxPast time.Duration, maxFuture time.Duration) (int64, bool) {
+	if maxPast > 0 {
+		if earliest := now.Add(-maxPast).UnixMilli(); timestamp < earliest {
+			return earliest, true
+		}
+	}
+	if maxFuture > 0 {
+		if latest := now.Add(maxFuture).UnixMilli(); timestamp > latest {
+			return latest, true
+		}
+	}
+	return timestamp, false
+}
@@ -0,0 +1,102 @@
+package emf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    interface{}
+		unit     string
+		expected int64
+	}{
+		{"Milliseconds", int64(1700000000123), common.TimestampUnitAuto, 1700000000123},
+		{"Seconds", int64(1700000000), common.TimestampUnitAuto, 1700000000000},
+		{"Fractional seconds", float64(1700000000.123), common.TimestampUnitAuto, 1700000000123},
+		{"Float milliseconds", float64(1700000000123), common.TimestampUnitAuto, 1700000000123},
+		{"Microseconds", uint64(1700000000123456), common.TimestampUnitAuto, 1700000000123},
+		{"Nanoseconds", int64(1700000000123456789), common.TimestampUnitAuto, 1700000000123},
+		{"Numeric string", "1700000000123", common.TimestampUnitAuto, 1700000000123},
+		{"Bytes", []byte("1700000000"), common.TimestampUnitAuto, 1700000000000},
+		{"RFC 3339", "2023-11-14T22:13:20.123Z", common.TimestampUnitAuto, 1700000000123},
+		{"Offset", "2023-11-15T00:13:20+02:00", common.TimestampUnitAuto, 1700000000000},
+		{"No zone", "2023-11-14 22:13:20", common.TimestampUnitAuto, 1700000000000},
+		{"Forced milliseconds", int64(1700000000), common.TimestampUnitMilliseconds, 1700000000},
+		{"Forced seconds", int64(1700000000123), common.TimestampUnitSeconds, 1700000000123000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := parseTimestamp(tc.input, tc.unit)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestParseTimestamp_InvalidInput(t *testing.T) {
+	for _, input := range []interface{}{"yesterday", true, nil, map[interface{}]interface{}{}, float64(1e300)} {
+		if _, err := parseTimestamp(input, common.TimestampUnitSeconds); err == nil {
+			t.Errorf("Expected error for %v", input)
+		}
+	}
+}
+
+func TestClampTimestamp(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	testCases := []struct {
+		name      string
+		input     int64
+		maxPast   time.Duration
+		maxFuture time.Duration
+		expected  int64
+		clamped   bool
+	}{
+		{"Within window", 1700000000000 - 1000, time.Hour, time.Hour, 1700000000000 - 1000, false},
+		{"Too old", 1000, time.Hour, time.Hour, 1700000000000 - 3600000, true},
+		{"Too new", 1800000000000, time.Hour, time.Hour, 1700000000000 + 3600000, true},
+		{"Unbounded", 1000, 0, 0, 1000, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, clamped := clampTimestamp(tc.input, now, tc.maxPast, tc.maxFuture)
+			if result != tc.expected || clamped != tc.clamped {
+				t.Errorf("Expected %d (%v), got %d (%v)", tc.expected, tc.clamped, result, clamped)
+			}
+		})
+	}
+}
+
+func TestEmfFromRecord_Timestamp(t *testing.T) {
+	record := func(aws map[interface{}]interface{}) map[interface{}]interface{} {
+		aws["CloudWatchMetrics"] = []interface{}{}
+		return map[interface{}]interface{}{"_aws": aws}
+	}
+	recordTime := time.UnixMilli(1700000000000)
+
+	emf, err := EmfFromRecord(record(map[interface{}]interface{}{}), nil, recordTime, "", &common.PluginOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if emf.AWS.Timestamp != 1700000000000 {
+		t.Errorf("Expected the record time 1700000000000, got %d", emf.AWS.Timestamp)
+	}
+
+	options := &common.PluginOptions{TimestampMaxPast: time.Hour, TimestampMaxFuture: time.Hour}
+	emf, err = EmfFromRecord(record(map[interface{}]interface{}{"Timestamp": int64(1000)}), nil, recordTime, "", options)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !emf.TimestampClamped || emf.AWS.Timestamp <= 1000 {
+		t.Errorf("Expected the timestamp to be clamped, got %d", emf.AWS.Timestamp)
+	}
+}
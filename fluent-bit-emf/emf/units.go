@@ -0,0 +1,170 @@
+package emf
+
+import (
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// unitScale places a unit on the scale of the quantity it measures, units of the same quantity
+// convert by the ratio of their scales
+type unitScale struct {
+	quantity string
+	scale    float64
+}
+
+// convertible CloudWatch units. Bytes use binary prefixes and bits decimal ones, as memory and
+// network throughput usually do
+var unitScales = map[string]unitScale{
+	"Microseconds": {"time", 1e-6},
+	"Milliseconds": {"time", 1e-3},
+	"Seconds":      {"time", 1},
+
+	"Bits":      {"data", 1},
+	"Kilobits":  {"data", 1e3},
+	"Megabits":  {"data", 1e6},
+	"Gigabits":  {"data", 1e9},
+	"Terabits":  {"data", 1e12},
+	"Bytes":     {"data", 8},
+	"Kilobytes": {"data", 8 << 10},
+	"Megabytes": {"data", 8 << 20},
+	"Gigabytes": {"data", 8 << 30},
+	"Terabytes": {"data", 8 << 40},
+
+	"Bits/Second":      {"rate", 1},
+	"Kilobits/Second":  {"rate", 1e3},
+	"Megabits/Second":  {"rate", 1e6},
+	"Gigabits/Second":  {"rate", 1e9},
+	"Terabits/Second":  {"rate", 1e12},
+	"Bytes/Second":     {"rate", 8},
+	"Kilobytes/Second": {"rate", 8 << 10},
+	"Megabytes/Second": {"rate", 8 << 20},
+	"Gigabytes/Second": {"rate", 8 << 30},
+	"Terabytes/Second": {"rate", 8 << 40},
+}
+
+// canonicalUnits is the unit each quantity is converted to, so a series ends up in the same unit
+// whichever unit it saw first
+var canonicalUnits = map[string]string{
+	"time": "Seconds",
+	"data": "Bytes",
+	"rate": "Bytes/Second",
+}
+
+// canonicalUnit returns the unit values in unit are converted to along with the factor to do so,
+// false when the unit isn't convertible
+func canonicalUnit(unit string) (string, float64, bool) {
+	scale, known := unitScales[unit]
+	if !known {
+		return "", 0, false
+	}
+	canonical := canonicalUnits[scale.quantity]
+	return canonical, scale.scale / unitScales[canonical].scale, true
+}
+
+// conversionFactor returns what to multiply a value in from by to get it in to, false when the
+// units measure different things
+func conversionFactor(from string, to string) (float64, bool) {
+	fromScale, fromKnown := unitScales[from]
+	toScale, toKnown := unitScales[to]
+	if !fromKnown || !toKnown || fromScale.quantity != toScale.quantity {
+		return 0, false
+	}
+	return fromScale.scale / toScale.scale, true
+}
+
+// scaled returns a copy of the value multiplied by factor, counts are unchanged
+func (v MetricValue) scaled(factor float64) MetricValue {
+	scale := func(f *float64) *float64 {
+		if f == nil {
+			return nil
+		}
+		scaled := *f * factor
+		return &scaled
+	}
+	result := MetricValue{
+		Value:  scale(v.Value),
+		Counts: v.Counts,
+		Min:    scale(v.Min),
+		Max:    scale(v.Max),
+		Sum:    scale(v.Sum),
+		Count:  v.Count,
+	}
+	if v.Values != nil {
+		result.Values = make([]float64, len(v.Values))
+		for i, value := range v.Values {
+			result.Values[i] = value * factor
+		}
+	}
+	return result
+}
+
+// UnitOf returns the unit of the first directive declaring the metric
+func (emf *EMFMetric) UnitOf(name string) string {
+	for _, metricDef := range emf.AWS.CloudWatchMetrics {
+		for _, metric := range metricDef.Metrics {
+			if metric.Name == name {
+				return metric.Unit
+			}
+		}
+	}
+	return ""
+}
+
+// seriesDirectives returns the record's directives without the excluded metrics and with every
+// metric declared in the unit its series has it in, the canonical one when converting, so merging
+// them never changes a unit. Metrics the series hasn't seen yet are added to units
+func (emf *EMFMetric) seriesDirectives(units map[string]string, excluded []string, converting bool) *common.AWSMetadata {
+	published := func(name string) string {
+		if canonical, _, convertible := canonicalUnit(units[name]); converting && convertible {
+			return canonical
+		}
+		return units[name]
+	}
+	changed := len(excluded) > 0
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		for _, metric := range def.Metrics {
+			if _, known := units[metric.Name]; !known {
+				units[metric.Name] = metric.Unit
+			}
+			if published(metric.Name) != metric.Unit {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return emf.AWS
+	}
+
+	aws := &common.AWSMetadata{Timestamp: emf.AWS.Timestamp}
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		metrics := make([]common.MetricDefinition, 0, len(def.Metrics))
+		for _, metric := range def.Metrics {
+			if utils.Find(excluded, func(name string) bool { return name == metric.Name }) == -1 {
+				metrics = append(metrics, common.MetricDefinition{Name: metric.Name, Unit: published(metric.Name)})
+			}
+		}
+		if len(metrics) > 0 {
+			def.Metrics = metrics
+			aws.CloudWatchMetrics = append(aws.CloudWatchMetrics, def)
+		}
+	}
+	return aws
+}
+
+// splitUnit returns the part of the record with only the named metrics, converted to unit when
+// they're in another one of its quantity, to be aggregated in a separate series for the unit
+func (emf *EMFMetric) splitUnit(unit string, names []string) *EMFMetric {
+	part := emf.withMetrics(names, true)
+	part.Split, part.SplitUnit = true, unit
+	for _, name := range names {
+		if factor, convertible := conversionFactor(emf.UnitOf(name), unit); convertible {
+			part.MetricData[name] = part.MetricData[name].scaled(factor)
+		}
+	}
+	for _, def := range part.AWS.CloudWatchMetrics {
+		for i := range def.Metrics {
+			def.Metrics[i].Unit = unit
+		}
+	}
+	return part
+}
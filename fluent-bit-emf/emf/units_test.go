@@ -0,0 +1,104 @@
+package emf
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+func TestConversionFactor(t *testing.T) {
+	for _, tc := range []struct {
+		from, to    string
+		factor      float64
+		convertible bool
+	}{
+		{from: "Microseconds", to: "Milliseconds", factor: 1e-3, convertible: true},
+		{from: "Seconds", to: "Milliseconds", factor: 1e3, convertible: true},
+		{from: "Kilobytes", to: "Bytes", factor: 1024, convertible: true},
+		{from: "Bytes", to: "Bits", factor: 8, convertible: true},
+		{from: "Megabits/Second", to: "Kilobits/Second", factor: 1e3, convertible: true},
+		{from: "Bytes", to: "Bytes/Second"},
+		{from: "Count", to: "Bytes"},
+		{from: "Percent", to: "None"},
+	} {
+		factor, convertible := conversionFactor(tc.from, tc.to)
+		if convertible != tc.convertible || math.Abs(factor-tc.factor) > 1e-9*tc.factor {
+			t.Errorf("%s to %s: expected %v %v, got %v %v", tc.from, tc.to, tc.factor, tc.convertible, factor, convertible)
+		}
+	}
+}
+
+func unitRecord(unit string, value float64) map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"_aws": map[interface{}]interface{}{
+			"Timestamp": int64(1700000000000),
+			"CloudWatchMetrics": []interface{}{
+				map[interface{}]interface{}{
+					"Namespace":  "TestNamespace",
+					"Dimensions": []interface{}{[]interface{}{"Service"}},
+					"Metrics":    []interface{}{map[interface{}]interface{}{"Name": "Latency", "Unit": unit}},
+				},
+			},
+		},
+		"Service": "api",
+		"Latency": value,
+	}
+}
+
+func TestAggregateMetric_UnitConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		mode  string
+		units []string
+		// sums of the series by the unit they're published in
+		sums  map[string]float64
+		stats UnitConflictStats
+	}{
+		// converted values end up in the canonical unit, whichever came first
+		{mode: common.UnitConflictsConvert, units: []string{"Milliseconds", "Microseconds"}, sums: map[string]float64{"Seconds": 0.003}, stats: UnitConflictStats{Converted: 1}},
+		{mode: common.UnitConflictsConvert, units: []string{"Microseconds", "Milliseconds"}, sums: map[string]float64{"Seconds": 2.000001}, stats: UnitConflictStats{Converted: 1}},
+		{mode: common.UnitConflictsConvert, units: []string{"Kilobytes", "Megabits"}, sums: map[string]float64{"Bytes": 1024 + 2000*1e6/8}, stats: UnitConflictStats{Converted: 1}},
+		{mode: common.UnitConflictsConvert, units: []string{"Milliseconds", "Milliseconds"}, sums: map[string]float64{"Seconds": 2.001}},
+		{mode: common.UnitConflictsConvert, units: []string{"Count", "Count"}, sums: map[string]float64{"Count": 2001}},
+		{mode: common.UnitConflictsConvert, units: []string{"Milliseconds", "Count"}, sums: map[string]float64{"Seconds": 0.001, "Count": 2000}, stats: UnitConflictStats{Split: 1}},
+		{mode: common.UnitConflictsSplit, units: []string{"Milliseconds", "Microseconds"}, sums: map[string]float64{"Milliseconds": 1, "Microseconds": 2000}, stats: UnitConflictStats{Split: 1}},
+		{mode: common.UnitConflictsReject, units: []string{"Milliseconds", "Microseconds"}, sums: map[string]float64{"Milliseconds": 1}, stats: UnitConflictStats{Rejected: 1}},
+		// values without a unit could be in any unit
+		{mode: common.UnitConflictsReject, units: []string{"Milliseconds", ""}, sums: map[string]float64{"Milliseconds": 1}, stats: UnitConflictStats{Rejected: 1}},
+		{mode: common.UnitConflictsReject, units: []string{"", "Milliseconds"}, sums: map[string]float64{"": 1}, stats: UnitConflictStats{Rejected: 1}},
+		{mode: common.UnitConflictsConvert, units: []string{"Milliseconds", ""}, sums: map[string]float64{"Seconds": 0.001, "": 2000}, stats: UnitConflictStats{Split: 1}},
+		{mode: common.UnitConflictsSplit, units: []string{"Milliseconds", ""}, sums: map[string]float64{"Milliseconds": 1, "": 2000}, stats: UnitConflictStats{Split: 1}},
+		{mode: common.UnitConflictsSplit, units: []string{"", "Milliseconds"}, sums: map[string]float64{"": 1, "Milliseconds": 2000}, stats: UnitConflictStats{Split: 1}},
+		// units of a quantity split off share a series
+		{mode: common.UnitConflictsConvert, units: []string{"", "Milliseconds", "Microseconds"}, sums: map[string]float64{"": 1, "Seconds": 2.003}, stats: UnitConflictStats{Split: 2}},
+	} {
+		options := &common.PluginOptions{UnitConflicts: tc.mode}
+		a := newTestAggregator(options)
+		for i, unit := range tc.units {
+			emf, err := EmfFromRecord(unitRecord(unit, []float64{1, 2000, 3000}[i]), nil, time.Now(), "", options)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			a.AggregateMetric(emf)
+		}
+
+		if len(a.metrics) != len(tc.sums) {
+			t.Errorf("%s %q: expected %d series, got %d", tc.mode, tc.units, len(tc.sums), len(a.metrics))
+		}
+		if a.stats.UnitConflicts != tc.stats {
+			t.Errorf("%s %q: expected %+v, got %+v", tc.mode, tc.units, tc.stats, a.stats.UnitConflicts)
+		}
+		for key, metadata := range a.metadataStore {
+			unit := metadata.AWS.CloudWatchMetrics[0].Metrics[0].Unit
+			expected, exists := tc.sums[unit]
+			if !exists {
+				t.Errorf("%s %q: expected no series in %q", tc.mode, tc.units, unit)
+				continue
+			}
+			if stats := a.metrics[key]["Latency"].Reduce(); math.Abs(stats.Sum-expected) > 1e-9*math.Max(1, expected) {
+				t.Errorf("%s %q: expected a sum of %v in %q, got %v", tc.mode, tc.units, expected, unit, stats.Sum)
+			}
+		}
+	}
+}
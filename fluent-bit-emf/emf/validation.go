@@ -0,0 +1,261 @@
+package emf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// CloudWatch limits, see https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+const (
+	maxDimensionsPerSet     = 30
+	maxMetricsPerDirective  = common.MaxMetricsPerDirective
+	maxDimensionValueLength = 1024
+	maxMetricNameLength     = 255
+)
+
+// Violations of the CloudWatch limits, each handled by its own action. They're also the
+// diagnostic reasons so every violation type is counted separately
+const (
+	ViolationDimensionsPerSet     = "dimensions_per_set"
+	ViolationMetricsPerDirective  = "metrics_per_directive"
+	ViolationDimensionValueLength = "dimension_value_length"
+	ViolationMetricNameLength     = "metric_name_length"
+	ViolationUnit                 = "unit"
+)
+
+var violations = []string{
+	ViolationDimensionsPerSet,
+	ViolationMetricsPerDirective,
+	ViolationDimensionValueLength,
+	ViolationMetricNameLength,
+	ViolationUnit,
+}
+
+// canonical spelling of every unit CloudWatch accepts, by lower case name
+var units = make(map[string]string)
+
+func init() {
+	for _, unit := range []string{
+		"Seconds", "Microseconds", "Milliseconds",
+		"Bytes", "Kilobytes", "Megabytes", "Gigabytes", "Terabytes",
+		"Bits", "Kilobits", "Megabits", "Gigabits", "Terabits",
+		"Percent", "Count", "None",
+		"Bytes/Second", "Kilobytes/Second", "Megabytes/Second", "Gigabytes/Second", "Terabytes/Second",
+		"Bits/Second", "Kilobits/Second", "Megabits/Second", "Gigabits/Second", "Terabits/Second",
+		"Count/Second",
+	} {
+		units[strings.ToLower(unit)] = unit
+	}
+}
+
+// ParseValidation parses `violation:action; ...`, where violation can be * for all of them.
+// Anything not mentioned is fixed: too many dimensions drops the set, too many metrics splits
+// the directive, long values and names are truncated and units are corrected if they only differ
+// by case and dropped otherwise. Truncate keeps the first dimensions and metrics instead
+func ParseValidation(config string) (map[string]string, error) {
+	actions := make(map[string]string, len(violations))
+	for _, violation := range violations {
+		actions[violation] = common.ValidationFix
+	}
+	for _, rule := range strings.Split(config, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		violation, action, found := strings.Cut(rule, ":")
+		violation, action = strings.TrimSpace(violation), strings.ToLower(strings.TrimSpace(action))
+		if !found {
+			return nil, fmt.Errorf("expected violation:action, was %q", rule)
+		}
+		switch action {
+		case common.ValidationFix, common.ValidationTruncate, common.ValidationReject, common.ValidationIgnore:
+		default:
+			return nil, fmt.Errorf("unknown action %q in %q, expected fix, truncate, reject or ignore", action, rule)
+		}
+		if violation == "*" {
+			for _, v := range violations {
+				actions[v] = action
+			}
+			continue
+		}
+		if utils.Find(violations, func(v string) bool { return v == violation }) == -1 {
+			return nil, fmt.Errorf("unknown violation %q, expected one of %s", violation, strings.Join(violations, ", "))
+		}
+		actions[violation] = action
+	}
+	return actions, nil
+}
+
+// validate enforces the CloudWatch limits on a parsed record. A rejected violation fails the
+// whole record, any other is corrected in place and recorded in the record's diagnostics
+func validate(emf *EMFMetric, actions map[string]string) error {
+	if actions == nil {
+		return nil
+	}
+	// resolves the action for a violation, reporting it unless it's ignored
+	check := func(violation string, path string, format string, v ...interface{}) (string, error) {
+		action := actions[violation]
+		detail := fmt.Sprintf(format, v...)
+		switch action {
+		case common.ValidationIgnore, "":
+			return common.ValidationIgnore, nil
+		case common.ValidationReject:
+			return action, fmt.Errorf("%s: %s: %s", path, violation, detail)
+		}
+		emf.Diagnostics.add(path, violation, "%s, %s", detail, action)
+		return action, nil
+	}
+
+	// metric names are checked first so the directives and values are renamed together
+	renamed := make(map[string]string)
+	// the original name of every metric name, names short enough are taken before any truncated
+	// one so a truncated name never replaces another metric, and of the metrics truncated to the
+	// same name only the first declared is kept
+	origins := make(map[string]string)
+	for _, def := range emf.AWS.CloudWatchMetrics {
+		for _, metric := range def.Metrics {
+			if len(metric.Name) <= maxMetricNameLength {
+				origins[metric.Name] = metric.Name
+			}
+		}
+	}
+	for i := range emf.AWS.CloudWatchMetrics {
+		def := &emf.AWS.CloudWatchMetrics[i]
+		kept := def.Metrics[:0]
+		for j := range def.Metrics {
+			metric := def.Metrics[j]
+			path := fmt.Sprintf("_aws.CloudWatchMetrics[%d].Metrics[%d]", i, j)
+			if len(metric.Name) > maxMetricNameLength {
+				action, err := check(ViolationMetricNameLength, path+".Name", "%d characters is over %d", len(metric.Name), maxMetricNameLength)
+				if err != nil {
+					return err
+				}
+				if action != common.ValidationIgnore {
+					truncated := truncate(metric.Name, maxMetricNameLength)
+					if origin, exists := origins[truncated]; exists && origin != metric.Name {
+						emf.Diagnostics.add(path+".Name", ReasonNameConflict, "truncated to the name of another metric")
+						continue
+					}
+					origins[truncated] = metric.Name
+					renamed[metric.Name] = truncated
+					metric.Name = truncated
+				}
+			}
+			if metric.Unit != "" {
+				if canonical, known := units[strings.ToLower(metric.Unit)]; !known || canonical != metric.Unit {
+					action, err := check(ViolationUnit, path+".Unit", "%q is not a CloudWatch unit", metric.Unit)
+					if err != nil {
+						return err
+					}
+					if action != common.ValidationIgnore {
+						// there's nothing to truncate, so both correct what they can
+						metric.Unit = canonical
+					}
+				}
+			}
+			kept = append(kept, metric)
+		}
+		def.Metrics = kept
+	}
+	for from, to := range renamed {
+		if value, exists := emf.MetricData[from]; exists {
+			delete(emf.MetricData, from)
+			emf.MetricData[to] = value
+		}
+	}
+
+	for name, value := range emf.Dimensions {
+		if len(value) > maxDimensionValueLength {
+			action, err := check(ViolationDimensionValueLength, name, "%d characters is over %d", len(value), maxDimensionValueLength)
+			if err != nil {
+				return err
+			}
+			if action != common.ValidationIgnore {
+				emf.Dimensions[name] = truncate(value, maxDimensionValueLength)
+			}
+		}
+	}
+
+	directives := make([]common.ProjectionDefinition, 0, len(emf.AWS.CloudWatchMetrics))
+	for i, def := range emf.AWS.CloudWatchMetrics {
+		path := fmt.Sprintf("_aws.CloudWatchMetrics[%d]", i)
+		if len(def.Metrics) == 0 {
+			// every metric had a name conflict
+			continue
+		}
+
+		dimensions := make([][]string, 0, len(def.Dimensions))
+		for j, dimSet := range def.Dimensions {
+			if len(dimSet) <= maxDimensionsPerSet {
+				dimensions = append(dimensions, dimSet)
+				continue
+			}
+			action, err := check(ViolationDimensionsPerSet, fmt.Sprintf("%s.Dimensions[%d]", path, j), "%d dimensions is over %d", len(dimSet), maxDimensionsPerSet)
+			if err != nil {
+				return err
+			}
+			switch action {
+			case common.ValidationIgnore:
+				dimensions = append(dimensions, dimSet)
+			case common.ValidationTruncate:
+				dimensions = append(dimensions, dimSet[:maxDimensionsPerSet])
+			}
+		}
+		if len(dimensions) == 0 && len(def.Dimensions) > 0 {
+			// like dropDimensions, rather than publishing the metrics without the dimensions they
+			// were meant to have
+			emf.Diagnostics.add(path+".Dimensions", ReasonNoDimensions, "every set was dropped")
+			continue
+		}
+		def.Dimensions = dimensions
+
+		if len(def.Metrics) <= maxMetricsPerDirective {
+			directives = append(directives, def)
+			continue
+		}
+		action, err := check(ViolationMetricsPerDirective, path+".Metrics", "%d metrics is over %d", len(def.Metrics), maxMetricsPerDirective)
+		if err != nil {
+			return err
+		}
+		switch action {
+		case common.ValidationIgnore:
+			directives = append(directives, def)
+		case common.ValidationTruncate:
+			def.Metrics = def.Metrics[:maxMetricsPerDirective]
+			directives = append(directives, def)
+		default:
+			for start := 0; start < len(def.Metrics); start += maxMetricsPerDirective {
+				split := def
+				end := start + maxMetricsPerDirective
+				if end > len(def.Metrics) {
+					end = len(def.Metrics)
+				}
+				split.Metrics = def.Metrics[start:end]
+				directives = append(directives, split)
+			}
+		}
+	}
+	emf.AWS.CloudWatchMetrics = directives
+
+	// values of truncated metrics no directive declares anymore
+	for name := range emf.MetricData {
+		if emf.NamespaceOf(name) == "" {
+			delete(emf.MetricData, name)
+		}
+	}
+	return nil
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
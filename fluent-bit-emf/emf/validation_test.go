@@ -0,0 +1,196 @@
+package emf
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+// oversizedRecord breaks every CloudWatch limit once
+func oversizedRecord() map[interface{}]interface{} {
+	dimensions := make([]interface{}, 31)
+	record := map[interface{}]interface{}{}
+	for i := range dimensions {
+		name := fmt.Sprintf("Dim%02d", i)
+		dimensions[i] = name
+		record[name] = "value"
+	}
+	record["Dim00"] = strings.Repeat("é", 600)
+
+	metrics := make([]interface{}, 0, 102)
+	for i := 0; i < 101; i++ {
+		name := fmt.Sprintf("Metric%03d", i)
+		metrics = append(metrics, map[interface{}]interface{}{"Name": name, "Unit": "count"})
+		record[name] = float64(i)
+	}
+	longName := strings.Repeat("L", 300)
+	metrics = append(metrics, map[interface{}]interface{}{"Name": longName, "Unit": "Furlongs"})
+	record[longName] = float64(1)
+
+	record["_aws"] = map[interface{}]interface{}{
+		"Timestamp": int64(1700000000000),
+		"CloudWatchMetrics": []interface{}{
+			map[interface{}]interface{}{
+				"Namespace":  "TestNamespace",
+				"Dimensions": []interface{}{dimensions, []interface{}{"Dim01"}},
+				"Metrics":    metrics,
+			},
+		},
+	}
+	return record
+}
+
+func TestValidateFix(t *testing.T) {
+	actions, err := ParseValidation("")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	emf, err := EmfFromRecord(oversizedRecord(), nil, time.Now(), "", &common.PluginOptions{Validation: actions})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	directives := emf.AWS.CloudWatchMetrics
+	if len(directives) != 2 || len(directives[0].Metrics) != 100 || len(directives[1].Metrics) != 2 {
+		t.Fatalf("Expected the directive to be split into 100 and 2 metrics, got %d directives", len(directives))
+	}
+	for _, def := range directives {
+		if len(def.Dimensions) != 1 || len(def.Dimensions[0]) != 1 {
+			t.Errorf("Expected only the small dimension set to be kept, got %v", def.Dimensions)
+		}
+	}
+	if unit := directives[0].Metrics[0].Unit; unit != "Count" {
+		t.Errorf("Expected the unit to be corrected to Count, got %q", unit)
+	}
+	last := directives[1].Metrics[1]
+	if len(last.Name) != 255 || last.Unit != "" {
+		t.Errorf("Expected a 255 character name without a unit, got %d characters and %q", len(last.Name), last.Unit)
+	}
+	if _, exists := emf.MetricData[last.Name]; !exists {
+		t.Error("Expected the metric value to follow the truncated name")
+	}
+	if value := emf.Dimensions["Dim00"]; len(value) != 1024 || !strings.HasSuffix(value, "é") {
+		t.Errorf("Expected the dimension value cut to 1024 bytes on a character boundary, got %d bytes", len(value))
+	}
+
+	counts := make(map[string]int)
+	for _, diagnostic := range emf.Diagnostics {
+		counts[diagnostic.Reason]++
+	}
+	expected := map[string]int{
+		ViolationDimensionsPerSet:     1,
+		ViolationMetricsPerDirective:  1,
+		ViolationDimensionValueLength: 1,
+		ViolationMetricNameLength:     1,
+		ViolationUnit:                 102,
+	}
+	for violation, count := range expected {
+		if counts[violation] != count {
+			t.Errorf("Expected %d %s diagnostics, got %d", count, violation, counts[violation])
+		}
+	}
+}
+
+func TestValidateTruncate(t *testing.T) {
+	actions, err := ParseValidation("*: truncate")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	emf, err := EmfFromRecord(oversizedRecord(), nil, time.Now(), "", &common.PluginOptions{Validation: actions})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	def := emf.AWS.CloudWatchMetrics[0]
+	if len(emf.AWS.CloudWatchMetrics) != 1 || len(def.Metrics) != 100 {
+		t.Fatalf("Expected one directive truncated to 100 metrics, got %+v", emf.AWS.CloudWatchMetrics)
+	}
+	if len(def.Dimensions[0]) != 30 {
+		t.Errorf("Expected the first dimension set truncated to 30, got %d", len(def.Dimensions[0]))
+	}
+	if _, exists := emf.MetricData["Metric100"]; exists {
+		t.Error("Expected the value of the truncated metric to be dropped")
+	}
+}
+
+func TestValidateTruncatedNameConflicts(t *testing.T) {
+	actions, err := ParseValidation("")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	prefix := strings.Repeat("L", 255)
+	// the metric already named like the truncation keeps its value, whatever the order
+	for _, names := range [][]string{{prefix + "A", prefix + "B", prefix}, {prefix, prefix + "B", prefix + "A"}} {
+		metrics := make([]interface{}, len(names))
+		record := map[interface{}]interface{}{}
+		for i, name := range names {
+			metrics[i] = map[interface{}]interface{}{"Name": name}
+			record[name] = float64(len(name))
+		}
+		record["_aws"] = map[interface{}]interface{}{
+			"Timestamp":         int64(1700000000000),
+			"CloudWatchMetrics": []interface{}{map[interface{}]interface{}{"Namespace": "NS", "Dimensions": []interface{}{}, "Metrics": metrics}},
+		}
+
+		emf, err := EmfFromRecord(record, nil, time.Now(), "", &common.PluginOptions{Validation: actions})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if value := emf.MetricData[prefix].Value; len(emf.MetricData) != 1 || value == nil || *value != 255 {
+			t.Errorf("Expected only the value of the metric already named %d Ls, got %+v", 255, emf.MetricData)
+		}
+		if declared := emf.AWS.CloudWatchMetrics[0].Metrics; len(declared) != 1 || declared[0].Name != prefix {
+			t.Errorf("Expected the conflicting metrics not to be declared, got %d", len(declared))
+		}
+	}
+
+	// of two truncated to the same name, the first declared wins
+	record := map[interface{}]interface{}{
+		"_aws": map[interface{}]interface{}{
+			"Timestamp": int64(1700000000000),
+			"CloudWatchMetrics": []interface{}{map[interface{}]interface{}{"Namespace": "NS", "Dimensions": []interface{}{}, "Metrics": []interface{}{
+				map[interface{}]interface{}{"Name": prefix + "B"},
+				map[interface{}]interface{}{"Name": prefix + "A"},
+			}}},
+		},
+		prefix + "A": float64(1),
+		prefix + "B": float64(2),
+	}
+	emf, err := EmfFromRecord(record, nil, time.Now(), "", &common.PluginOptions{Validation: actions})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if value := emf.MetricData[prefix].Value; len(emf.MetricData) != 1 || value == nil || *value != 2 {
+		t.Errorf("Expected the value of the first declared metric, got %+v", emf.MetricData)
+	}
+}
+
+func TestValidateRejectAndIgnore(t *testing.T) {
+	actions, err := ParseValidation("*:ignore; unit:reject")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := EmfFromRecord(oversizedRecord(), nil, time.Now(), "", &common.PluginOptions{Validation: actions}); err == nil {
+		t.Error("Expected the record to be rejected for its units")
+	}
+
+	actions, _ = ParseValidation("*:ignore")
+	emf, err := EmfFromRecord(oversizedRecord(), nil, time.Now(), "", &common.PluginOptions{Validation: actions})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(emf.Diagnostics) != 0 || len(emf.AWS.CloudWatchMetrics[0].Metrics) != 102 {
+		t.Errorf("Expected ignored violations to leave the record as is, got %v", emf.Diagnostics)
+	}
+}
+
+func TestParseValidationInvalid(t *testing.T) {
+	for _, config := range []string{"unit", "unit:explode", "colour:fix"} {
+		if _, err := ParseValidation(config); err == nil {
+			t.Errorf("Expected error for %q", config)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package flush
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"time"
 
@@ -59,6 +58,19 @@ func init_cloudwatch_flush(groupName string, streamName string, endpoint string,
 }
 
 func (f *cloudwatchFlusher) Flush(events []common.EMFEvent) (int, int, error) {
+	messages, err := marshalEvents(events)
+	if err != nil {
+		return 0, 0, err
+	}
+	return f.FlushRaw(messages)
+}
+
+// Close has nothing to release, every put is its own request
+func (f *cloudwatchFlusher) Close() error {
+	return nil
+}
+
+func (f *cloudwatchFlusher) FlushRaw(messages [][]byte) (int, int, error) {
 	totalSize := 0
 	totalCount := 0
 
@@ -66,13 +78,8 @@ func (f *cloudwatchFlusher) Flush(events []common.EMFEvent) (int, int, error) {
 	currentBatch := make([]types.InputLogEvent, 0, maximumLogEventsPerPut)
 	currentBatchSize := 0
 
-	for _, event := range events {
-		marshalled, err := json.Marshal(event)
-		if err != nil {
-			return totalSize, totalCount, fmt.Errorf("failed to marshal event: %v", err)
-		}
-
-		data := string(marshalled)
+	for _, message := range messages {
+		data := string(message)
 
 		if (len(data) + perEventBytes) > maximumBytesPerEvent {
 			log.Warn().Printf("dropping event that is too large to send, was %d\n", len(data))
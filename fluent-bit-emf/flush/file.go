@@ -1,7 +1,6 @@
 package flush
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -9,8 +8,7 @@ import (
 )
 
 type fileFlusher struct {
-	file         *os.File
-	file_encoder *json.Encoder
+	file *os.File
 }
 
 func init_file_flush(outputPath string) (*fileFlusher, error) {
@@ -29,24 +27,34 @@ func init_file_flush(outputPath string) (*fileFlusher, error) {
 	}
 
 	flusher := &fileFlusher{}
-	// Create encoder with indentation for readability
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "")
-	flusher.file_encoder = encoder
 	flusher.file = file
 	return flusher, nil
 }
 
 func (f *fileFlusher) Flush(events []common.EMFEvent) (int, int, error) {
-	// Encode the map
+	messages, err := marshalEvents(events)
+	if err != nil {
+		return 0, 0, err
+	}
+	return f.FlushRaw(messages)
+}
+
+func (f *fileFlusher) Close() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %v", f.file.Name(), err)
+	}
+	return nil
+}
+
+func (f *fileFlusher) FlushRaw(messages [][]byte) (int, int, error) {
 	size_prior, err := f.file.Stat()
 	if err != nil {
 		return 0, 0, fmt.Errorf("failed to stat file %s: %v", f.file.Name(), err)
 	}
-	// we have to encode these one at a time so they are individual events rather than a json array
+	// we have to write these one at a time so they are individual events rather than a json array
 	count := 0
-	for _, event := range events {
-		if err := f.file_encoder.Encode(event); err != nil {
+	for _, message := range messages {
+		if _, err := f.file.Write(append(message, '\n')); err != nil {
 			return 0, 0, fmt.Errorf("failed to write to file %s: %v", f.file.Name(), err)
 		}
 		count++
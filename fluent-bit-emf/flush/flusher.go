@@ -1,6 +1,7 @@
 package flush
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
@@ -8,10 +9,39 @@ import (
 
 type Flusher interface {
 	Flush(events []common.EMFEvent) (int, int, error)
+	Close() error
+}
+
+// RawFlusher writes already marshalled JSON messages, one line or log event each
+type RawFlusher interface {
+	FlushRaw(messages [][]byte) (int, int, error)
+	Close() error
+}
+
+type destination interface {
+	Flusher
+	RawFlusher
 }
 
 func InitFlusher(options *common.PluginOptions) (Flusher, error) {
-	var flusher Flusher
+	if UsesTagPlaceholder(options) {
+		return newTagRouter(options, initFlusher), nil
+	}
+	return initFlusher(options)
+}
+
+// InitRawFlusher creates the destination described by options for messages that aren't EMF,
+// the $(tag) placeholder isn't supported
+func InitRawFlusher(options *common.PluginOptions) (RawFlusher, error) {
+	return initDestination(options)
+}
+
+func initFlusher(options *common.PluginOptions) (Flusher, error) {
+	return initDestination(options)
+}
+
+func initDestination(options *common.PluginOptions) (destination, error) {
+	var flusher destination
 	var err error
 	if options.OutputPath != "" {
 		flusher, err = init_file_flush(options.OutputPath)
@@ -23,3 +53,15 @@ func InitFlusher(options *common.PluginOptions) (Flusher, error) {
 
 	return flusher, err
 }
+
+func marshalEvents(events []common.EMFEvent) ([][]byte, error) {
+	messages := make([][]byte, 0, len(events))
+	for _, event := range events {
+		marshalled, err := json.Marshal(event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal event: %v", err)
+		}
+		messages = append(messages, marshalled)
+	}
+	return messages, nil
+}
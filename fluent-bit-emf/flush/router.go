@@ -0,0 +1,127 @@
+package flush
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+// TagPlaceholder in output_path, log_group_name or log_stream_name is replaced with each event's tag
+const TagPlaceholder = "$(tag)"
+
+// maxTagDestinations bounds the open destinations, the least recently used is closed past it
+const maxTagDestinations = 64
+
+// characters that aren't safe in a file name or a CloudWatch log stream name
+var tagSanitizer = strings.NewReplacer("/", "_", "\\", "_", ":", "_", "*", "_")
+
+// tagRouter sends events to a destination per sanitized tag, creating each one the first time it's
+// seen. Tags that sanitize the same share a destination
+type tagRouter struct {
+	options  common.PluginOptions
+	flushers map[string]*routedFlusher
+	max      int
+	flushes  uint64
+	create   func(options *common.PluginOptions) (Flusher, error)
+}
+
+type routedFlusher struct {
+	Flusher
+	// lastUsed is the flush the destination was last written in
+	lastUsed uint64
+}
+
+// UsesTagPlaceholder reports whether the destination depends on the tag
+func UsesTagPlaceholder(options *common.PluginOptions) bool {
+	return strings.Contains(options.OutputPath, TagPlaceholder) ||
+		strings.Contains(options.LogGroupName, TagPlaceholder) ||
+		strings.Contains(options.LogStreamName, TagPlaceholder)
+}
+
+func newTagRouter(options *common.PluginOptions, create func(options *common.PluginOptions) (Flusher, error)) *tagRouter {
+	return &tagRouter{
+		options:  *options,
+		flushers: make(map[string]*routedFlusher),
+		max:      maxTagDestinations,
+		create:   create,
+	}
+}
+
+// optionsFor returns the options with every placeholder replaced by the sanitized tag
+func (r *tagRouter) optionsFor(sanitized string) *common.PluginOptions {
+	options := r.options
+	options.OutputPath = strings.ReplaceAll(options.OutputPath, TagPlaceholder, sanitized)
+	options.LogGroupName = strings.ReplaceAll(options.LogGroupName, TagPlaceholder, sanitized)
+	options.LogStreamName = strings.ReplaceAll(options.LogStreamName, TagPlaceholder, sanitized)
+	return &options
+}
+
+func (r *tagRouter) Flush(events []common.EMFEvent) (int, int, error) {
+	r.flushes++
+	byTag := make(map[string][]common.EMFEvent)
+	tags := make([]string, 0)
+	for _, event := range events {
+		sanitized := tagSanitizer.Replace(event.Tag)
+		if _, exists := byTag[sanitized]; !exists {
+			tags = append(tags, sanitized)
+		}
+		byTag[sanitized] = append(byTag[sanitized], event)
+	}
+
+	totalSize := 0
+	totalCount := 0
+	for _, tag := range tags {
+		flusher, exists := r.flushers[tag]
+		if !exists {
+			if len(r.flushers) >= r.max {
+				if err := r.evict(); err != nil {
+					return totalSize, totalCount, err
+				}
+			}
+			created, err := r.create(r.optionsFor(tag))
+			if err != nil {
+				return totalSize, totalCount, fmt.Errorf("failed to create destination for tag %q: %w", tag, err)
+			}
+			flusher = &routedFlusher{Flusher: created}
+			r.flushers[tag] = flusher
+		}
+		flusher.lastUsed = r.flushes
+		size, count, err := flusher.Flush(byTag[tag])
+		totalSize += size
+		totalCount += count
+		if err != nil {
+			return totalSize, totalCount, err
+		}
+	}
+	return totalSize, totalCount, nil
+}
+
+// evict closes the least recently used destination, it's recreated when its tag is seen again
+func (r *tagRouter) evict() error {
+	var oldest string
+	var flusher *routedFlusher
+	for tag, candidate := range r.flushers {
+		if flusher == nil || candidate.lastUsed < flusher.lastUsed {
+			oldest, flusher = tag, candidate
+		}
+	}
+	delete(r.flushers, oldest)
+	if err := flusher.Close(); err != nil {
+		return fmt.Errorf("failed to close destination for tag %q: %w", oldest, err)
+	}
+	return nil
+}
+
+// Close closes every open destination
+func (r *tagRouter) Close() error {
+	var errs []error
+	for tag, flusher := range r.flushers {
+		if err := flusher.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close destination for tag %q: %w", tag, err))
+		}
+	}
+	r.flushers = make(map[string]*routedFlusher)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,88 @@
+package flush
+
+import (
+	"testing"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+)
+
+type recordingFlusher struct {
+	events []common.EMFEvent
+	closed bool
+}
+
+func (f *recordingFlusher) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *recordingFlusher) Flush(events []common.EMFEvent) (int, int, error) {
+	f.events = append(f.events, events...)
+	return 0, len(events), nil
+}
+
+func TestTagRouter(t *testing.T) {
+	created := make(map[string]*recordingFlusher)
+	router := newTagRouter(&common.PluginOptions{LogGroupName: "metrics", LogStreamName: "emf-" + TagPlaceholder}, func(options *common.PluginOptions) (Flusher, error) {
+		flusher := &recordingFlusher{}
+		created[options.LogStreamName] = flusher
+		return flusher, nil
+	})
+
+	events := []common.EMFEvent{{Tag: "app.web"}, {Tag: "kube:api/v1"}, {Tag: "app.web"}, {Tag: "kube/api:v1"}}
+	if _, count, err := router.Flush(events); err != nil || count != 4 {
+		t.Fatalf("Expected 4 events flushed, got %d (%v)", count, err)
+	}
+	if _, _, err := router.Flush(events[:1]); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(created) != 2 {
+		t.Fatalf("Expected a destination per tag, got %v", created)
+	}
+	if web := created["emf-app.web"]; web == nil || len(web.events) != 3 {
+		t.Errorf("Expected 3 events routed to emf-app.web, got %v", web)
+	}
+	if api := created["emf-kube_api_v1"]; api == nil || len(api.events) != 2 {
+		t.Errorf("Expected both tags sanitized to emf-kube_api_v1 to share it, got %v", api)
+	}
+
+	if err := router.Close(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for name, flusher := range created {
+		if !flusher.closed {
+			t.Errorf("Expected %s to be closed", name)
+		}
+	}
+}
+
+func TestTagRouter_Eviction(t *testing.T) {
+	created := make(map[string][]*recordingFlusher)
+	router := newTagRouter(&common.PluginOptions{OutputPath: "/tmp/" + TagPlaceholder}, func(options *common.PluginOptions) (Flusher, error) {
+		flusher := &recordingFlusher{}
+		created[options.OutputPath] = append(created[options.OutputPath], flusher)
+		return flusher, nil
+	})
+	router.max = 2
+
+	for _, tag := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, _, err := router.Flush([]common.EMFEvent{{Tag: tag}}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(router.flushers) > router.max {
+			t.Fatalf("Expected at most %d open destinations, got %d", router.max, len(router.flushers))
+		}
+	}
+
+	// b was the least recently used when c came in, then c when b came back
+	if a := created["/tmp/a"]; len(a) != 1 || a[0].closed {
+		t.Errorf("Expected /tmp/a to stay open, got %v", a)
+	}
+	if b := created["/tmp/b"]; len(b) != 2 || !b[0].closed || b[1].closed {
+		t.Errorf("Expected /tmp/b to be closed on eviction and reopened, got %v", b)
+	}
+	if c := created["/tmp/c"]; len(c) != 1 || !c[0].closed {
+		t.Errorf("Expected /tmp/c to be evicted, got %v", c)
+	}
+}
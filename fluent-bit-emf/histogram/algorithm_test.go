@@ -0,0 +1,183 @@
+package histogram
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDDSketchRelativeAccuracy(t *testing.T) {
+	for _, accuracy := range []float64{0.01, 0.05} {
+		h := NewHistogram(Options{Algorithm: AlgorithmDDSketch, RelativeAccuracy: accuracy})
+		for v := 0.001; v < 1e6; v *= 1.37 {
+			h.Add(v, 1)
+			h.Add(-v, 1)
+		}
+		h.Add(0, 3)
+
+		stats := h.Reduce()
+		d := h.algorithm.(*ddSketch)
+		for v := 0.001; v < 1e6; v *= 1.37 {
+			for _, value := range []float64{v, -v} {
+				var index int
+				var buckets map[int]uint64
+				if value > 0 {
+					index, buckets = d.index(value), d.positive
+				} else {
+					index, buckets = d.index(-value), d.negative
+				}
+				if buckets[index] == 0 {
+					t.Fatalf("Expected %v to be counted", value)
+				}
+				representative := math.Abs(d.valueOf(index))
+				if err := math.Abs(representative-math.Abs(value)) / math.Abs(value); err > accuracy+1e-12 {
+					t.Errorf("Expected relative error <= %v for %v, got %v", accuracy, value, err)
+				}
+			}
+		}
+
+		for i := 1; i < len(stats.Values); i++ {
+			if stats.Values[i] <= stats.Values[i-1] {
+				t.Fatalf("Expected ascending values, got %v", stats.Values)
+			}
+		}
+		if stats.Min != -stats.Max {
+			t.Errorf("Expected symmetric min/max, got %v/%v", stats.Min, stats.Max)
+		}
+	}
+}
+
+func TestExplicitBuckets(t *testing.T) {
+	h := NewHistogram(Options{Algorithm: AlgorithmExplicit, Boundaries: []float64{10, 100}})
+	h.Add(1, 1)
+	h.Add(10, 1) // boundaries are inclusive
+	h.Add(50, 2)
+	h.Add(1000, 1)
+
+	stats := h.Reduce()
+	expected := &HistogramStats{
+		Values: []float64{5.5, 50, 1000},
+		Counts: []uint64{2, 2, 1},
+		Min:    1,
+		Max:    1000,
+		Sum:    1111,
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestExactAlgorithm(t *testing.T) {
+	h := NewHistogram(Options{Algorithm: AlgorithmExact})
+	for _, code := range []float64{200, 200, 404, 500, 503, 200} {
+		h.Add(code, 1)
+	}
+
+	stats := h.Reduce()
+	if !reflect.DeepEqual(stats.Values, []float64{200, 404, 500, 503}) || !reflect.DeepEqual(stats.Counts, []uint64{3, 1, 1, 1}) {
+		t.Errorf("Expected exact counts, got %v %v", stats.Values, stats.Counts)
+	}
+}
+
+func TestAlgorithmRoundTrips(t *testing.T) {
+	for _, options := range []Options{
+		{Algorithm: AlgorithmSEH, BucketMeans: true},
+		{Algorithm: AlgorithmExact},
+		{Algorithm: AlgorithmDDSketch, RelativeAccuracy: 0.02},
+		{Algorithm: AlgorithmExplicit, Boundaries: []float64{1, 2, 3}},
+	} {
+		t.Run(options.Algorithm, func(t *testing.T) {
+			h := NewHistogram(options)
+			for _, v := range []float64{-1, 0, 0.5, 1.5, 2, 2.5, 100} {
+				h.Add(v, 2)
+			}
+
+			data, err := h.MarshalBinary()
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			decoded := NewHistogram(Options{})
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(h, decoded) {
+				t.Errorf("Expected %+v, got %+v", h.algorithm, decoded.algorithm)
+			}
+
+			data, err = h.MarshalJSON()
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			decoded = NewHistogram(Options{})
+			if err := decoded.UnmarshalJSON(data); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(h, decoded) {
+				t.Errorf("Expected %+v, got %+v", h.algorithm, decoded.algorithm)
+			}
+		})
+	}
+}
+
+func TestMergeAlgorithms(t *testing.T) {
+	ddsketch := NewHistogram(Options{Algorithm: AlgorithmDDSketch})
+	if err := ddsketch.Merge(NewHistogram(Options{Algorithm: AlgorithmExact})); !errors.Is(err, ErrIncompatibleAlgorithm) {
+		t.Errorf("Expected %v, got %v", ErrIncompatibleAlgorithm, err)
+	}
+	if err := ddsketch.Merge(NewHistogram(Options{Algorithm: AlgorithmDDSketch, RelativeAccuracy: 0.05})); !errors.Is(err, ErrIncompatibleScale) {
+		t.Errorf("Expected %v, got %v", ErrIncompatibleScale, err)
+	}
+
+	explicit := NewHistogram(Options{Algorithm: AlgorithmExplicit, Boundaries: []float64{1}})
+	if err := explicit.Merge(NewHistogram(Options{Algorithm: AlgorithmExplicit, Boundaries: []float64{2}})); !errors.Is(err, ErrIncompatibleScale) {
+		t.Errorf("Expected %v, got %v", ErrIncompatibleScale, err)
+	}
+
+	other := NewHistogram(Options{Algorithm: AlgorithmExplicit, Boundaries: []float64{1}})
+	explicit.Add(0.5, 1)
+	other.Add(5, 1)
+	if err := explicit.Merge(other); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if stats := explicit.Reduce(); stats.Min != 0.5 || stats.Max != 5 || stats.Sum != 5.5 {
+		t.Errorf("Expected merged stats, got %+v", stats)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("MyService/* Latency ddsketch:0.02; * RequestSize explicit:100, 1000,10000;* StatusCode EXACT ;")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := Rules{
+		{Namespace: "MyService/*", Metric: "Latency", Algorithm: AlgorithmDDSketch, RelativeAccuracy: 0.02},
+		{Namespace: "*", Metric: "RequestSize", Algorithm: AlgorithmExplicit, Boundaries: []float64{100, 1000, 10000}},
+		{Namespace: "*", Metric: "StatusCode", Algorithm: AlgorithmExact},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rules)
+	}
+
+	base := Options{BucketMeans: true}
+	if options := rules.Options("MyService/api", "Latency", base); options.Algorithm != AlgorithmDDSketch || !options.BucketMeans {
+		t.Errorf("Expected ddsketch with base options kept, got %+v", options)
+	}
+	if options := rules.Options("Other", "Latency", base); options.Algorithm != "" {
+		t.Errorf("Expected no rule to match, got %+v", options)
+	}
+
+	for _, invalid := range []string{
+		"* Latency",
+		"* Latency unknown",
+		"* Latency ddsketch:2",
+		"* Latency explicit:",
+		"* Latency explicit:10,5",
+		"* Latency exact:1",
+	} {
+		if _, err := ParseRules(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ddSketch is a DDSketch style relative error sketch. Rather than calling math.Log for
+// every value it indexes on a piecewise linear approximation of log2, read straight off
+// the float's exponent and mantissa; the multiplier is widened to compensate so every
+// reported value stays within relativeAccuracy of the values in its bucket
+type ddSketch struct {
+	relativeAccuracy float64
+	multiplier       float64
+	positive         map[int]uint64
+	negative         map[int]uint64
+	zeroCount        uint64
+	count            uint64
+	sum              compensatedSum
+	min              float64
+	max              float64
+}
+
+func newDDSketch(relativeAccuracy float64) *ddSketch {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &ddSketch{
+		relativeAccuracy: relativeAccuracy,
+		// the approximation's slope is between ln2 and 2ln2 of the real log2, so a bucket
+		// 1/multiplier wide in approximated space is at most log2(gamma) wide in real space
+		multiplier: 1 / math.Log(gamma),
+		positive:   make(map[int]uint64),
+		negative:   make(map[int]uint64),
+		min:        math.MaxFloat64,
+		max:        -math.MaxFloat64,
+	}
+}
+
+// approximateLog2 is exact at powers of two and linear in between
+func approximateLog2(value float64) float64 {
+	frac, exp := math.Frexp(value)
+	// value = frac * 2^exp with frac in [0.5, 1), rewrite as (1 + m) * 2^(exp-1) with m in [0, 1)
+	return float64(exp-1) + (2*frac - 1)
+}
+
+// inverseApproximateLog2 is the inverse of approximateLog2
+func inverseApproximateLog2(log float64) float64 {
+	exp := math.Floor(log)
+	return math.Ldexp(1+log-exp, int(exp))
+}
+
+// index returns the bucket for a strictly positive value
+func (d *ddSketch) index(value float64) int {
+	return int(math.Floor(approximateLog2(value) * d.multiplier))
+}
+
+// valueOf returns the point with the lowest relative error to every value in the bucket
+func (d *ddSketch) valueOf(index int) float64 {
+	lower := inverseApproximateLog2(float64(index) / d.multiplier)
+	upper := inverseApproximateLog2(float64(index+1) / d.multiplier)
+	return 2 * lower * upper / (lower + upper)
+}
+
+func (d *ddSketch) Add(value float64, count uint64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) || count == 0 {
+		return nil
+	}
+	// no bucket can overflow unless the total does
+	total, err := addCount(d.count, count)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case value > 0:
+		d.positive[d.index(value)] += count
+	case value < 0:
+		d.negative[d.index(-value)] += count
+	default:
+		d.zeroCount += count
+	}
+	d.count = total
+	d.sum.AddProduct(value, count)
+	d.min = math.Min(d.min, value)
+	d.max = math.Max(d.max, value)
+	return nil
+}
+
+func (d *ddSketch) Merge(other Algorithm) error {
+	o, ok := other.(*ddSketch)
+	if !ok {
+		return fmt.Errorf("%w: can't merge %T into %s", ErrIncompatibleAlgorithm, other, AlgorithmDDSketch)
+	}
+	if o.relativeAccuracy != d.relativeAccuracy {
+		return fmt.Errorf("%w: relative accuracy %v != %v", ErrIncompatibleScale, o.relativeAccuracy, d.relativeAccuracy)
+	}
+	total, err := addCount(d.count, o.count)
+	if err != nil {
+		return err
+	}
+	for index, count := range o.positive {
+		d.positive[index] += count
+	}
+	for index, count := range o.negative {
+		d.negative[index] += count
+	}
+	d.zeroCount += o.zeroCount
+	d.count = total
+	d.sum.Merge(o.sum)
+	d.min = math.Min(d.min, o.min)
+	d.max = math.Max(d.max, o.max)
+	return nil
+}
+
+func (d *ddSketch) Reduce() *HistogramStats {
+	if d.count == 0 {
+		return nil
+	}
+
+	stats := &HistogramStats{
+		Values: make([]float64, 0, len(d.negative)+len(d.positive)+1),
+		Counts: make([]uint64, 0, len(d.negative)+len(d.positive)+1),
+		Min:    d.min,
+		Max:    d.max,
+		Sum:    d.sum.Value(),
+	}
+	// representatives can fall just outside the observed range at the edges, clamping them
+	// keeps the emitted values consistent with Min and Max and only reduces the error
+	clamp := func(value float64) float64 {
+		return math.Max(d.min, math.Min(d.max, value))
+	}
+
+	negatives := sortedIndexes(d.negative)
+	for i := len(negatives) - 1; i >= 0; i-- {
+		stats.Values = append(stats.Values, clamp(-d.valueOf(negatives[i])))
+		stats.Counts = append(stats.Counts, d.negative[negatives[i]])
+	}
+	if d.zeroCount > 0 {
+		stats.Values = append(stats.Values, 0)
+		stats.Counts = append(stats.Counts, d.zeroCount)
+	}
+	for _, index := range sortedIndexes(d.positive) {
+		stats.Values = append(stats.Values, clamp(d.valueOf(index)))
+		stats.Counts = append(stats.Counts, d.positive[index])
+	}
+	return stats
+}
+
+// sortedIndexes returns the bucket indexes in ascending order
+func sortedIndexes(buckets map[int]uint64) []int {
+	indexes := make([]int, 0, len(buckets))
+	for index := range buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
@@ -0,0 +1,789 @@
+package histogram
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Binary layout, all multi-byte floats are little endian IEEE 754 bits:
+//
+//	header:      magic (1 byte) | version (1 byte) | kind (1 byte)
+//	sum:         float64 sum | float64 compensation
+//	histogram:   uvarint count | sum | float64 min | float64 max | uvarint significantDigits |
+//	             algorithm (header and payload)
+//	values:      uvarint len | len * (float64 value | uvarint count)
+//	buckets:     uvarint len | len * (varint index delta | uvarint count [| sum bucket sum])
+//
+//	exact:       values
+//	seh:         uvarint flags | values
+//	exponential: float64 binSize | uvarint count | sum | float64 min | float64 max | uvarint flags | buckets
+//	ddsketch:    float64 relativeAccuracy | uvarint count | sum | float64 min | float64 max |
+//	             uvarint zeroCount | buckets (positive) | buckets (negative)
+//	explicit:    uvarint len | len * float64 boundary | uvarint count | sum | float64 min | float64 max |
+//	             (len + 1) * (uvarint count | sum bucket sum)
+//
+// buckets are written in ascending index order with each index stored as the delta from
+// the previous one, which keeps dense sketches small; the bucket sum is only present when
+// flagBucketSums is set
+const (
+	encodingMagic   byte  = 0xE7
+	encodingVersion uint8 = 2
+	// bucketingVersion is the version of the exponential bucketing scheme, it only changes
+	// when bucket indexes do so sketches of different encoding versions can still be merged
+	bucketingVersion uint8 = 1
+
+	kindExact       byte = 1
+	kindExponential byte = 2
+	kindSEH         byte = 3
+	kindDDSketch    byte = 4
+	kindExplicit    byte = 5
+	kindHistogram   byte = 6
+
+	headerLength = 3
+
+	flagBucketSums uint64 = 1 << 0
+)
+
+var (
+	ErrIncompatibleVersion   = errors.New("incompatible histogram version")
+	ErrIncompatibleScale     = errors.New("incompatible histogram scale")
+	ErrIncompatibleOptions   = errors.New("incompatible histogram options")
+	ErrIncompatibleAlgorithm = errors.New("incompatible histogram algorithm")
+	ErrInvalidEncoding       = errors.New("invalid histogram encoding")
+)
+
+func appendHeader(buf []byte, kind byte) []byte {
+	return append(buf, encodingMagic, encodingVersion, kind)
+}
+
+// readHeader validates the header and returns the remaining payload
+func readHeader(data []byte, kind byte) ([]byte, error) {
+	if len(data) < headerLength {
+		return nil, fmt.Errorf("%w: too short for header", ErrInvalidEncoding)
+	}
+	if data[0] != encodingMagic {
+		return nil, fmt.Errorf("%w: bad magic byte %#x", ErrInvalidEncoding, data[0])
+	}
+	if data[1] != encodingVersion {
+		return nil, fmt.Errorf("%w: can't decode version %d", ErrIncompatibleVersion, data[1])
+	}
+	if data[2] != kind {
+		return nil, fmt.Errorf("%w: expected kind %d, was %d", ErrInvalidEncoding, kind, data[2])
+	}
+	return data[headerLength:], nil
+}
+
+// checkBinSize rejects bin sizes no bucket index can be computed with
+func checkBinSize(binSize float64) error {
+	if !(binSize > 0) || math.IsInf(binSize, 0) {
+		return fmt.Errorf("%w: bin size %v", ErrIncompatibleScale, binSize)
+	}
+	return nil
+}
+
+func checkJSONVersion(version uint8) error {
+	if version != encodingVersion {
+		return fmt.Errorf("%w: can't decode version %d", ErrIncompatibleVersion, version)
+	}
+	return nil
+}
+
+// reader is a small cursor over an encoded payload, the first error encountered sticks
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) float64() float64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 8 {
+		r.err = fmt.Errorf("%w: unexpected end of data", ErrInvalidEncoding)
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.data))
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("%w: malformed uvarint", ErrInvalidEncoding)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("%w: malformed varint", ErrInvalidEncoding)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// length reads an element count and sanity checks it against the remaining data
+// so a corrupt payload can't make us allocate huge slices
+func (r *reader) length(minElementSize int) int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data)/minElementSize) {
+		r.err = fmt.Errorf("%w: length %d exceeds remaining data", ErrInvalidEncoding, n)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) flags(known uint64) uint64 {
+	flags := r.uvarint()
+	if r.err == nil && flags&^known != 0 {
+		r.err = fmt.Errorf("%w: unknown flags %#x", ErrInvalidEncoding, flags)
+	}
+	return flags
+}
+
+func (r *reader) values() ([]float64, []uint64) {
+	n := r.length(8 + 1)
+	values := make([]float64, n)
+	counts := make([]uint64, n)
+	for i := 0; i < n; i++ {
+		values[i] = r.float64()
+		counts[i] = r.uvarint()
+	}
+	return values, counts
+}
+
+func (r *reader) sum() compensatedSum {
+	return compensatedSum{Sum: r.float64(), Compensation: r.float64()}
+}
+
+// buckets reads a bucket map, the sums map is only returned when withSums is set
+func (r *reader) buckets(withSums bool) (map[int]uint64, map[int]*compensatedSum) {
+	entrySize := 1 + 1
+	var sums map[int]*compensatedSum
+	if withSums {
+		entrySize += 2 * 8
+		sums = make(map[int]*compensatedSum)
+	}
+	n := r.length(entrySize)
+	buckets := make(map[int]uint64, n)
+	index := 0
+	for i := 0; i < n; i++ {
+		index += int(r.varint())
+		buckets[index] = r.uvarint()
+		if sums != nil {
+			sum := r.sum()
+			sums[index] = &sum
+		}
+	}
+	return buckets, sums
+}
+
+func (r *reader) finish() error {
+	if r.err == nil && len(r.data) != 0 {
+		r.err = fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, len(r.data))
+	}
+	return r.err
+}
+
+func appendFloat64(buf []byte, v float64) []byte {
+	return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+}
+
+func appendSum(buf []byte, sum compensatedSum) []byte {
+	return appendFloat64(appendFloat64(buf, sum.Sum), sum.Compensation)
+}
+
+func appendValues(buf []byte, values []float64, counts []uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(values)))
+	for i := range values {
+		buf = appendFloat64(buf, values[i])
+		buf = binary.AppendUvarint(buf, counts[i])
+	}
+	return buf
+}
+
+// appendBuckets writes buckets in ascending index order so encodings are deterministic
+// sums are written alongside each bucket when not nil
+func appendBuckets(buf []byte, buckets map[int]uint64, sums map[int]*compensatedSum) []byte {
+	indexes := sortedIndexes(buckets)
+	buf = binary.AppendUvarint(buf, uint64(len(indexes)))
+	previous := 0
+	for _, index := range indexes {
+		buf = binary.AppendVarint(buf, int64(index-previous))
+		buf = binary.AppendUvarint(buf, buckets[index])
+		if sums != nil {
+			var sum compensatedSum
+			if sums[index] != nil {
+				sum = *sums[index]
+			}
+			buf = appendSum(buf, sum)
+		}
+		previous = index
+	}
+	return buf
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, the encoding records which algorithm is in use
+func (va *Histogram) MarshalBinary() ([]byte, error) {
+	sketch, err := va.algorithm.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, headerLength+binary.MaxVarintLen64+4*8+len(sketch))
+	buf = appendHeader(buf, kindHistogram)
+	buf = binary.AppendUvarint(buf, va.count)
+	buf = appendSum(buf, va.sum)
+	buf = appendFloat64(buf, va.min)
+	buf = appendFloat64(buf, va.max)
+	buf = binary.AppendUvarint(buf, uint64(va.significantDigits))
+	return append(buf, sketch...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, replacing the algorithm and its state
+// with the encoded one
+func (va *Histogram) UnmarshalBinary(data []byte) error {
+	payload, err := readHeader(data, kindHistogram)
+	if err != nil {
+		return err
+	}
+	r := &reader{data: payload}
+	count := r.uvarint()
+	sum := r.sum()
+	min := r.float64()
+	max := r.float64()
+	significantDigits := r.uvarint()
+	if r.err != nil {
+		return r.err
+	}
+	if significantDigits > math.MaxInt32 {
+		return fmt.Errorf("%w: %d significant digits", ErrInvalidEncoding, significantDigits)
+	}
+	sketch := r.data
+	if len(sketch) < headerLength {
+		return fmt.Errorf("%w: too short for algorithm header", ErrInvalidEncoding)
+	}
+
+	var algorithm interface {
+		Algorithm
+		UnmarshalBinary(data []byte) error
+	}
+	switch sketch[2] {
+	case kindExact:
+		algorithm = &exactAlgorithm{}
+	case kindSEH:
+		algorithm = &sehAlgorithm{}
+	case kindDDSketch:
+		algorithm = &ddSketch{}
+	case kindExplicit:
+		algorithm = &explicitBuckets{}
+	default:
+		return fmt.Errorf("%w: unknown algorithm kind %d", ErrInvalidEncoding, sketch[2])
+	}
+	if err := algorithm.UnmarshalBinary(sketch); err != nil {
+		return err
+	}
+	va.significantDigits = int(significantDigits)
+	va.algorithm = algorithm
+	va.count = count
+	va.sum = sum
+	va.min = min
+	va.max = max
+	return nil
+}
+
+type histogramJSON struct {
+	Version           uint8           `json:"version"`
+	Count             uint64          `json:"count"`
+	Sum               compensatedSum  `json:"sum"`
+	Min               float64         `json:"min"`
+	Max               float64         `json:"max"`
+	SignificantDigits int             `json:"significantDigits"`
+	Sketch            json.RawMessage `json:"sketch"`
+}
+
+// MarshalJSON produces a human readable form of the histogram state, intended for debugging
+func (va *Histogram) MarshalJSON() ([]byte, error) {
+	sketch, err := va.algorithm.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(histogramJSON{
+		Version:           encodingVersion,
+		Count:             va.count,
+		Sum:               va.sum,
+		Min:               va.min,
+		Max:               va.max,
+		SignificantDigits: va.significantDigits,
+		Sketch:            sketch,
+	})
+}
+
+func (va *Histogram) UnmarshalJSON(data []byte) error {
+	var decoded histogramJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(decoded.Version); err != nil {
+		return err
+	}
+	if decoded.SignificantDigits < 0 {
+		return fmt.Errorf("%w: %d significant digits", ErrInvalidEncoding, decoded.SignificantDigits)
+	}
+	var peek struct {
+		Algorithm string `json:"algorithm"`
+	}
+	if err := json.Unmarshal(decoded.Sketch, &peek); err != nil {
+		return err
+	}
+	var algorithm interface {
+		Algorithm
+		json.Unmarshaler
+	}
+	switch peek.Algorithm {
+	case AlgorithmExact:
+		algorithm = &exactAlgorithm{}
+	case AlgorithmSEH:
+		algorithm = &sehAlgorithm{}
+	case AlgorithmDDSketch:
+		algorithm = &ddSketch{}
+	case AlgorithmExplicit:
+		algorithm = &explicitBuckets{}
+	default:
+		return fmt.Errorf("%w: unknown algorithm %q", ErrInvalidEncoding, peek.Algorithm)
+	}
+	if err := json.Unmarshal(decoded.Sketch, algorithm); err != nil {
+		return err
+	}
+	va.significantDigits = decoded.SignificantDigits
+	va.algorithm = algorithm
+	va.count = decoded.Count
+	va.sum = decoded.Sum
+	va.min = decoded.Min
+	va.max = decoded.Max
+	return nil
+}
+
+func (e *exactAlgorithm) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, headerLength+binary.MaxVarintLen64+len(e.values)*(8+2))
+	buf = appendHeader(buf, kindExact)
+	return appendValues(buf, e.values, e.counts), nil
+}
+
+func (e *exactAlgorithm) UnmarshalBinary(data []byte) error {
+	payload, err := readHeader(data, kindExact)
+	if err != nil {
+		return err
+	}
+	r := &reader{data: payload}
+	values, counts := r.values()
+	if err := r.finish(); err != nil {
+		return err
+	}
+	e.values = values
+	e.counts = counts
+	return nil
+}
+
+type exactJSON struct {
+	Algorithm string    `json:"algorithm"`
+	Version   uint8     `json:"version"`
+	Values    []float64 `json:"values"`
+	Counts    []uint64  `json:"counts"`
+}
+
+func (e *exactAlgorithm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(exactJSON{
+		Algorithm: AlgorithmExact,
+		Version:   encodingVersion,
+		Values:    e.values,
+		Counts:    e.counts,
+	})
+}
+
+func (e *exactAlgorithm) UnmarshalJSON(data []byte) error {
+	var decoded exactJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(decoded.Version); err != nil {
+		return err
+	}
+	if len(decoded.Values) != len(decoded.Counts) {
+		return fmt.Errorf("%w: %d values but %d counts", ErrInvalidEncoding, len(decoded.Values), len(decoded.Counts))
+	}
+	e.values = append(make([]float64, 0, len(decoded.Values)), decoded.Values...)
+	e.counts = append(make([]uint64, 0, len(decoded.Counts)), decoded.Counts...)
+	return nil
+}
+
+func (s *sehAlgorithm) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, headerLength+2*binary.MaxVarintLen64+len(s.exact.values)*(8+2))
+	buf = appendHeader(buf, kindSEH)
+	var flags uint64
+	if s.bucketMeans {
+		flags |= flagBucketSums
+	}
+	buf = binary.AppendUvarint(buf, flags)
+	return appendValues(buf, s.exact.values, s.exact.counts), nil
+}
+
+func (s *sehAlgorithm) UnmarshalBinary(data []byte) error {
+	payload, err := readHeader(data, kindSEH)
+	if err != nil {
+		return err
+	}
+	r := &reader{data: payload}
+	flags := r.flags(flagBucketSums)
+	values, counts := r.values()
+	if err := r.finish(); err != nil {
+		return err
+	}
+	s.bucketMeans = flags&flagBucketSums != 0
+	s.exact = &exactAlgorithm{values: values, counts: counts}
+	return nil
+}
+
+type sehJSON struct {
+	Algorithm   string    `json:"algorithm"`
+	Version     uint8     `json:"version"`
+	BucketMeans bool      `json:"bucketMeans"`
+	Values      []float64 `json:"values"`
+	Counts      []uint64  `json:"counts"`
+}
+
+func (s *sehAlgorithm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sehJSON{
+		Algorithm:   AlgorithmSEH,
+		Version:     encodingVersion,
+		BucketMeans: s.bucketMeans,
+		Values:      s.exact.values,
+		Counts:      s.exact.counts,
+	})
+}
+
+func (s *sehAlgorithm) UnmarshalJSON(data []byte) error {
+	var decoded sehJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	exact := &exactAlgorithm{}
+	if err := exact.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	s.bucketMeans = decoded.BucketMeans
+	s.exact = exact
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (h *exponentialHistogram) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, headerLength+4*8+3*binary.MaxVarintLen64+len(h.buckets)*2)
+	buf = appendHeader(buf, kindExponential)
+	buf = appendFloat64(buf, h.binSize)
+	buf = binary.AppendUvarint(buf, h.count)
+	buf = appendSum(buf, h.sum)
+	buf = appendFloat64(buf, h.min)
+	buf = appendFloat64(buf, h.max)
+	var flags uint64
+	if h.sums != nil {
+		flags |= flagBucketSums
+	}
+	buf = binary.AppendUvarint(buf, flags)
+	return appendBuckets(buf, h.buckets, h.sums), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, replacing any existing state
+func (h *exponentialHistogram) UnmarshalBinary(data []byte) error {
+	payload, err := readHeader(data, kindExponential)
+	if err != nil {
+		return err
+	}
+	r := &reader{data: payload}
+	binSize := r.float64()
+	count := r.uvarint()
+	sum := r.sum()
+	min := r.float64()
+	max := r.float64()
+	flags := r.flags(flagBucketSums)
+	buckets, sums := r.buckets(flags&flagBucketSums != 0)
+	if err := r.finish(); err != nil {
+		return err
+	}
+	if err := checkBinSize(binSize); err != nil {
+		return err
+	}
+
+	h.version = bucketingVersion
+	h.binSize = binSize
+	h.count = count
+	h.sum = sum
+	h.min = min
+	h.max = max
+	h.buckets = buckets
+	h.sums = sums
+	return nil
+}
+
+type exponentialHistogramJSON struct {
+	Version uint8          `json:"version"`
+	BinSize float64        `json:"binSize"`
+	Count   uint64         `json:"count"`
+	Sum     compensatedSum `json:"sum"`
+	Min     float64        `json:"min"`
+	Max     float64        `json:"max"`
+	Buckets map[int]uint64 `json:"buckets"`
+	// only present when bucket means are tracked
+	Sums map[int]*compensatedSum `json:"sums,omitempty"`
+}
+
+// MarshalJSON produces a human readable form of the sketch state, intended for debugging
+func (h *exponentialHistogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(exponentialHistogramJSON{
+		Version: encodingVersion,
+		BinSize: h.binSize,
+		Count:   h.count,
+		Sum:     h.sum,
+		Min:     h.min,
+		Max:     h.max,
+		Buckets: h.buckets,
+		Sums:    h.sums,
+	})
+}
+
+func (h *exponentialHistogram) UnmarshalJSON(data []byte) error {
+	var decoded exponentialHistogramJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(decoded.Version); err != nil {
+		return err
+	}
+	if err := checkBinSize(decoded.BinSize); err != nil {
+		return err
+	}
+	if decoded.Buckets == nil {
+		decoded.Buckets = make(map[int]uint64)
+	}
+	h.version = bucketingVersion
+	h.binSize = decoded.BinSize
+	h.count = decoded.Count
+	h.sum = decoded.Sum
+	h.min = decoded.Min
+	h.max = decoded.Max
+	h.buckets = decoded.Buckets
+	h.sums = decoded.Sums
+	return nil
+}
+
+func (d *ddSketch) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, headerLength+4*8+4*binary.MaxVarintLen64+(len(d.positive)+len(d.negative))*2)
+	buf = appendHeader(buf, kindDDSketch)
+	buf = appendFloat64(buf, d.relativeAccuracy)
+	buf = binary.AppendUvarint(buf, d.count)
+	buf = appendSum(buf, d.sum)
+	buf = appendFloat64(buf, d.min)
+	buf = appendFloat64(buf, d.max)
+	buf = binary.AppendUvarint(buf, d.zeroCount)
+	buf = appendBuckets(buf, d.positive, nil)
+	return appendBuckets(buf, d.negative, nil), nil
+}
+
+func (d *ddSketch) UnmarshalBinary(data []byte) error {
+	payload, err := readHeader(data, kindDDSketch)
+	if err != nil {
+		return err
+	}
+	r := &reader{data: payload}
+	relativeAccuracy := r.float64()
+	count := r.uvarint()
+	sum := r.sum()
+	min := r.float64()
+	max := r.float64()
+	zeroCount := r.uvarint()
+	positive, _ := r.buckets(false)
+	negative, _ := r.buckets(false)
+	if err := r.finish(); err != nil {
+		return err
+	}
+	if !(relativeAccuracy > 0 && relativeAccuracy < 1) {
+		return fmt.Errorf("%w: relative accuracy %v", ErrIncompatibleScale, relativeAccuracy)
+	}
+
+	*d = *newDDSketch(relativeAccuracy)
+	d.count = count
+	d.sum = sum
+	d.min = min
+	d.max = max
+	d.zeroCount = zeroCount
+	d.positive = positive
+	d.negative = negative
+	return nil
+}
+
+type ddSketchJSON struct {
+	Algorithm        string         `json:"algorithm"`
+	Version          uint8          `json:"version"`
+	RelativeAccuracy float64        `json:"relativeAccuracy"`
+	Count            uint64         `json:"count"`
+	Sum              compensatedSum `json:"sum"`
+	Min              float64        `json:"min"`
+	Max              float64        `json:"max"`
+	ZeroCount        uint64         `json:"zeroCount"`
+	Positive         map[int]uint64 `json:"positive"`
+	Negative         map[int]uint64 `json:"negative"`
+}
+
+func (d *ddSketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ddSketchJSON{
+		Algorithm:        AlgorithmDDSketch,
+		Version:          encodingVersion,
+		RelativeAccuracy: d.relativeAccuracy,
+		Count:            d.count,
+		Sum:              d.sum,
+		Min:              d.min,
+		Max:              d.max,
+		ZeroCount:        d.zeroCount,
+		Positive:         d.positive,
+		Negative:         d.negative,
+	})
+}
+
+func (d *ddSketch) UnmarshalJSON(data []byte) error {
+	var decoded ddSketchJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(decoded.Version); err != nil {
+		return err
+	}
+	if !(decoded.RelativeAccuracy > 0 && decoded.RelativeAccuracy < 1) {
+		return fmt.Errorf("%w: relative accuracy %v", ErrIncompatibleScale, decoded.RelativeAccuracy)
+	}
+	*d = *newDDSketch(decoded.RelativeAccuracy)
+	d.count = decoded.Count
+	d.sum = decoded.Sum
+	d.min = decoded.Min
+	d.max = decoded.Max
+	d.zeroCount = decoded.ZeroCount
+	if decoded.Positive != nil {
+		d.positive = decoded.Positive
+	}
+	if decoded.Negative != nil {
+		d.negative = decoded.Negative
+	}
+	return nil
+}
+
+func (e *explicitBuckets) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, headerLength+(len(e.boundaries)+4)*8+2*binary.MaxVarintLen64+len(e.counts)*(8+2))
+	buf = appendHeader(buf, kindExplicit)
+	buf = binary.AppendUvarint(buf, uint64(len(e.boundaries)))
+	for _, boundary := range e.boundaries {
+		buf = appendFloat64(buf, boundary)
+	}
+	buf = binary.AppendUvarint(buf, e.count)
+	buf = appendSum(buf, e.sum)
+	buf = appendFloat64(buf, e.min)
+	buf = appendFloat64(buf, e.max)
+	for i := range e.counts {
+		buf = binary.AppendUvarint(buf, e.counts[i])
+		buf = appendSum(buf, e.sums[i])
+	}
+	return buf, nil
+}
+
+func (e *explicitBuckets) UnmarshalBinary(data []byte) error {
+	payload, err := readHeader(data, kindExplicit)
+	if err != nil {
+		return err
+	}
+	r := &reader{data: payload}
+	boundaries := make([]float64, r.length(8))
+	for i := range boundaries {
+		boundaries[i] = r.float64()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if err := checkBoundaries(boundaries); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	decoded := newExplicitBuckets(boundaries)
+	decoded.count = r.uvarint()
+	decoded.sum = r.sum()
+	decoded.min = r.float64()
+	decoded.max = r.float64()
+	for i := range decoded.counts {
+		decoded.counts[i] = r.uvarint()
+		decoded.sums[i] = r.sum()
+	}
+	if err := r.finish(); err != nil {
+		return err
+	}
+	*e = *decoded
+	return nil
+}
+
+type explicitBucketsJSON struct {
+	Algorithm  string           `json:"algorithm"`
+	Version    uint8            `json:"version"`
+	Boundaries []float64        `json:"boundaries"`
+	Count      uint64           `json:"count"`
+	Sum        compensatedSum   `json:"sum"`
+	Min        float64          `json:"min"`
+	Max        float64          `json:"max"`
+	Counts     []uint64         `json:"counts"`
+	Sums       []compensatedSum `json:"sums"`
+}
+
+func (e *explicitBuckets) MarshalJSON() ([]byte, error) {
+	return json.Marshal(explicitBucketsJSON{
+		Algorithm:  AlgorithmExplicit,
+		Version:    encodingVersion,
+		Boundaries: e.boundaries,
+		Count:      e.count,
+		Sum:        e.sum,
+		Min:        e.min,
+		Max:        e.max,
+		Counts:     e.counts,
+		Sums:       e.sums,
+	})
+}
+
+func (e *explicitBuckets) UnmarshalJSON(data []byte) error {
+	var decoded explicitBucketsJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(decoded.Version); err != nil {
+		return err
+	}
+	if len(decoded.Counts) != len(decoded.Boundaries)+1 || len(decoded.Sums) != len(decoded.Counts) {
+		return fmt.Errorf("%w: expected %d buckets for %d boundaries", ErrInvalidEncoding, len(decoded.Boundaries)+1, len(decoded.Boundaries))
+	}
+	if err := checkBoundaries(decoded.Boundaries); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	*e = *newExplicitBuckets(decoded.Boundaries)
+	e.count = decoded.Count
+	e.sum = decoded.Sum
+	e.min = decoded.Min
+	e.max = decoded.Max
+	copy(e.counts, decoded.Counts)
+	copy(e.sums, decoded.Sums)
+	return nil
+}
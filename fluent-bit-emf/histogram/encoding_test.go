@@ -0,0 +1,232 @@
+package histogram
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestHistogramBinaryRoundTrip(t *testing.T) {
+	h := NewHistogram(Options{})
+	h.Add(1.5, 3)
+	h.Add(-2.25, 1)
+	h.Add(1e300, 1<<40)
+
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	decoded := NewHistogram(Options{})
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !reflect.DeepEqual(h, decoded) {
+		t.Errorf("Expected %+v, got %+v", h, decoded)
+	}
+}
+
+func TestExponentialHistogramBinaryRoundTrip(t *testing.T) {
+	h := NewExponentialHistogram(false)
+	for _, v := range []float64{0.001, 0.5, 1, 2, 3, 1000, 1e9} {
+		h.Add(v, 7)
+	}
+	h.Add(-1, 1) // non-positive values land in bucket 0
+
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	decoded := &exponentialHistogram{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !reflect.DeepEqual(h, decoded) {
+		t.Errorf("Expected %+v, got %+v", h, decoded)
+	}
+
+	// encoding must be deterministic regardless of map iteration order
+	again, _ := decoded.MarshalBinary()
+	if !reflect.DeepEqual(data, again) {
+		t.Errorf("Expected re-encoding to be identical")
+	}
+}
+
+func TestExponentialHistogramEmptyRoundTrip(t *testing.T) {
+	h := NewExponentialHistogram(false)
+
+	data, _ := h.MarshalBinary()
+	decoded := &exponentialHistogram{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(h, decoded) {
+		t.Errorf("Expected %+v, got %+v", h, decoded)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	h := NewHistogram(Options{})
+	h.Add(0.1, 1)
+	h.Add(0.2, 2)
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	decoded := NewHistogram(Options{})
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(h, decoded) {
+		t.Errorf("Expected %+v, got %+v", h, decoded)
+	}
+
+	seh := NewExponentialHistogram(false)
+	seh.Add(math.Pi, 3)
+	seh.Add(1/3.0, 1)
+
+	data, err = json.Marshal(seh)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	decodedSeh := &exponentialHistogram{}
+	if err := json.Unmarshal(data, decodedSeh); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(seh, decodedSeh) {
+		t.Errorf("Expected %+v, got %+v", seh, decodedSeh)
+	}
+}
+
+func TestUnmarshalBinaryInvalid(t *testing.T) {
+	valid, _ := NewExponentialHistogram(false).MarshalBinary()
+
+	testCases := []struct {
+		name     string
+		input    []byte
+		expected error
+	}{
+		{"Empty", []byte{}, ErrInvalidEncoding},
+		{"Bad magic", []byte{0x00, encodingVersion, kindExponential}, ErrInvalidEncoding},
+		{"Old version", []byte{encodingMagic, encodingVersion - 1, kindExponential}, ErrIncompatibleVersion},
+		{"Future version", []byte{encodingMagic, encodingVersion + 1, kindExponential}, ErrIncompatibleVersion},
+		{"Wrong kind", []byte{encodingMagic, encodingVersion, kindExact, 0}, ErrInvalidEncoding},
+		{"Truncated", valid[:len(valid)-1], ErrInvalidEncoding},
+		{"Trailing bytes", append(append([]byte{}, valid...), 0), ErrInvalidEncoding},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&exponentialHistogram{}).UnmarshalBinary(tc.input)
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestMergeIncompatible(t *testing.T) {
+	h := NewExponentialHistogram(false)
+
+	other := NewExponentialHistogram(false)
+	other.binSize = math.Log(1 + 2*epsilon)
+	if err := h.Merge(other); !errors.Is(err, ErrIncompatibleScale) {
+		t.Errorf("Expected %v, got %v", ErrIncompatibleScale, err)
+	}
+
+	other = NewExponentialHistogram(false)
+	other.version = encodingVersion + 1
+	if err := h.Merge(other); !errors.Is(err, ErrIncompatibleVersion) {
+		t.Errorf("Expected %v, got %v", ErrIncompatibleVersion, err)
+	}
+}
+
+func TestSignificantDigitsRoundTrip(t *testing.T) {
+	h := NewHistogram(Options{SignificantDigits: 2})
+	h.Add(1.234, 1)
+	h.Add(1.236, 1)
+
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	decoded := NewHistogram(Options{})
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(h.Reduce(), decoded.Reduce()) {
+		t.Errorf("Expected %+v, got %+v", h.Reduce(), decoded.Reduce())
+	}
+
+	data, err = json.Marshal(h)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	decoded = NewHistogram(Options{})
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(h, decoded) {
+		t.Errorf("Expected %+v, got %+v", h, decoded)
+	}
+}
+
+func TestUnmarshalCorrupt(t *testing.T) {
+	explicit := func(boundaries ...float64) []byte {
+		data, _ := newExplicitBuckets(boundaries).MarshalBinary()
+		return data
+	}
+	explicitJSON := func(boundaries ...float64) []byte {
+		data, _ := json.Marshal(explicitBucketsJSON{
+			Algorithm:  AlgorithmExplicit,
+			Version:    encodingVersion,
+			Boundaries: boundaries,
+			Counts:     make([]uint64, len(boundaries)+1),
+			Sums:       make([]compensatedSum, len(boundaries)+1),
+		})
+		return data
+	}
+	exponential := func(binSize float64) []byte {
+		h := NewExponentialHistogram(false)
+		h.binSize = binSize
+		data, _ := h.MarshalBinary()
+		return data
+	}
+
+	testCases := []struct {
+		name     string
+		decode   func() error
+		expected error
+	}{
+		{"Descending boundaries", func() error { return (&explicitBuckets{}).UnmarshalBinary(explicit(10, 1)) }, ErrInvalidEncoding},
+		{"Repeated boundaries", func() error { return (&explicitBuckets{}).UnmarshalBinary(explicit(1, 1)) }, ErrInvalidEncoding},
+		{"Infinite boundary", func() error { return (&explicitBuckets{}).UnmarshalBinary(explicit(1, math.Inf(1))) }, ErrInvalidEncoding},
+		{"NaN boundary", func() error { return (&explicitBuckets{}).UnmarshalBinary(explicit(math.NaN())) }, ErrInvalidEncoding},
+		{"Descending JSON boundaries", func() error { return json.Unmarshal(explicitJSON(10, 1), &explicitBuckets{}) }, ErrInvalidEncoding},
+		{"Zero bin size", func() error { return (&exponentialHistogram{}).UnmarshalBinary(exponential(0)) }, ErrIncompatibleScale},
+		{"Infinite bin size", func() error { return (&exponentialHistogram{}).UnmarshalBinary(exponential(math.Inf(1))) }, ErrIncompatibleScale},
+		{"Zero JSON bin size", func() error {
+			return json.Unmarshal([]byte(`{"version":2,"binSize":0,"buckets":{}}`), &exponentialHistogram{})
+		}, ErrIncompatibleScale},
+		{"Negative significant digits", func() error {
+			return json.Unmarshal([]byte(`{"version":2,"significantDigits":-1,"sketch":{"algorithm":"exact","version":2}}`), NewHistogram(Options{}))
+		}, ErrInvalidEncoding},
+		{"Old JSON version", func() error {
+			return json.Unmarshal([]byte(`{"version":1,"sketch":{"algorithm":"exact","version":1}}`), NewHistogram(Options{}))
+		}, ErrIncompatibleVersion},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.decode(); !errors.Is(err, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package histogram
+
+import (
+	"fmt"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// exactAlgorithm keeps a count for every distinct value and emits them as is
+// this is only a good fit for low cardinality metrics such as status codes
+type exactAlgorithm struct {
+	values []float64
+	counts []uint64
+}
+
+func newExactAlgorithm() *exactAlgorithm {
+	return &exactAlgorithm{
+		values: make([]float64, 0),
+		counts: make([]uint64, 0),
+	}
+}
+
+func (e *exactAlgorithm) Add(value float64, count uint64) error {
+	for i := 0; i < len(e.values); i++ {
+		if e.values[i] == value {
+			total, err := addCount(e.counts[i], count)
+			if err != nil {
+				return err
+			}
+			e.counts[i] = total
+			return nil
+		}
+	}
+	e.values = append(e.values, value)
+	e.counts = append(e.counts, count)
+	return nil
+}
+
+func (e *exactAlgorithm) Reduce() *HistogramStats {
+	if len(e.values) == 0 {
+		return nil
+	}
+	stats := &HistogramStats{
+		Values: append(make([]float64, 0, len(e.values)), e.values...),
+		Counts: append(make([]uint64, 0, len(e.counts)), e.counts...),
+		Min:    e.values[0],
+		Max:    e.values[0],
+	}
+	var sum compensatedSum
+	for i := range e.values {
+		stats.Min = utils.Min(stats.Min, e.values[i])
+		stats.Max = utils.Max(stats.Max, e.values[i])
+		sum.AddProduct(e.values[i], e.counts[i])
+	}
+	stats.Sum = sum.Value()
+	return stats
+}
+
+func (e *exactAlgorithm) Merge(other Algorithm) error {
+	o, ok := other.(*exactAlgorithm)
+	if !ok {
+		return fmt.Errorf("%w: can't merge %T into %s", ErrIncompatibleAlgorithm, other, AlgorithmExact)
+	}
+	return e.merge(o)
+}
+
+// merge checks every count first so an overflow leaves e untouched
+func (e *exactAlgorithm) merge(other *exactAlgorithm) error {
+	for i := range other.values {
+		if index := utils.Find(e.values, func(v float64) bool { return v == other.values[i] }); index != -1 {
+			if _, err := addCount(e.counts[index], other.counts[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range other.values {
+		_ = e.Add(other.values[i], other.counts[i])
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// explicitBuckets counts values into user defined buckets. Boundaries are inclusive upper
+// bounds with a final overflow bucket for anything above the last one; since the buckets
+// can be arbitrarily wide each one is reported at the mean of the values that fell into it
+type explicitBuckets struct {
+	boundaries []float64
+	// one more entry than boundaries, the last being the overflow bucket
+	counts []uint64
+	sums   []compensatedSum
+	count  uint64
+	sum    compensatedSum
+	min    float64
+	max    float64
+}
+
+func newExplicitBuckets(boundaries []float64) *explicitBuckets {
+	return &explicitBuckets{
+		boundaries: append(make([]float64, 0, len(boundaries)), boundaries...),
+		counts:     make([]uint64, len(boundaries)+1),
+		sums:       make([]compensatedSum, len(boundaries)+1),
+		min:        math.MaxFloat64,
+		max:        -math.MaxFloat64,
+	}
+}
+
+func (e *explicitBuckets) Add(value float64, count uint64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) || count == 0 {
+		return nil
+	}
+	// no bucket can overflow unless the total does
+	total, err := addCount(e.count, count)
+	if err != nil {
+		return err
+	}
+
+	bucket := sort.SearchFloat64s(e.boundaries, value)
+	e.counts[bucket] += count
+	e.sums[bucket].AddProduct(value, count)
+	e.count = total
+	e.sum.AddProduct(value, count)
+	e.min = math.Min(e.min, value)
+	e.max = math.Max(e.max, value)
+	return nil
+}
+
+func (e *explicitBuckets) Merge(other Algorithm) error {
+	o, ok := other.(*explicitBuckets)
+	if !ok {
+		return fmt.Errorf("%w: can't merge %T into %s", ErrIncompatibleAlgorithm, other, AlgorithmExplicit)
+	}
+	if !equalBoundaries(e.boundaries, o.boundaries) {
+		return fmt.Errorf("%w: boundaries %v != %v", ErrIncompatibleScale, o.boundaries, e.boundaries)
+	}
+	total, err := addCount(e.count, o.count)
+	if err != nil {
+		return err
+	}
+	for i := range o.counts {
+		e.counts[i] += o.counts[i]
+		e.sums[i].Merge(o.sums[i])
+	}
+	e.count = total
+	e.sum.Merge(o.sum)
+	e.min = math.Min(e.min, o.min)
+	e.max = math.Max(e.max, o.max)
+	return nil
+}
+
+func (e *explicitBuckets) Reduce() *HistogramStats {
+	if e.count == 0 {
+		return nil
+	}
+
+	stats := &HistogramStats{
+		Values: make([]float64, 0, len(e.counts)),
+		Counts: make([]uint64, 0, len(e.counts)),
+		Min:    e.min,
+		Max:    e.max,
+		Sum:    e.sum.Value(),
+	}
+	for i := range e.counts {
+		if e.counts[i] == 0 {
+			continue
+		}
+		stats.Values = append(stats.Values, e.sums[i].Value()/float64(e.counts[i]))
+		stats.Counts = append(stats.Counts, e.counts[i])
+	}
+	return stats
+}
+
+// checkBoundaries returns an error unless the boundaries are finite and strictly ascending,
+// which the bucket search relies on
+func checkBoundaries(boundaries []float64) error {
+	for i, boundary := range boundaries {
+		if math.IsNaN(boundary) || math.IsInf(boundary, 0) {
+			return fmt.Errorf("boundary %v isn't finite", boundary)
+		}
+		if i > 0 && !(boundary > boundaries[i-1]) {
+			return fmt.Errorf("boundaries must be strictly ascending, were %v", boundaries)
+		}
+	}
+	return nil
+}
+
+func equalBoundaries(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
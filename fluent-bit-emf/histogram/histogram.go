@@ -1,88 +1,265 @@
 package histogram
 
 import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
 )
 
+const (
+	// AlgorithmSEH keeps exact values while there are only a couple of them, otherwise it
+	// reduces them through a sparse exponential histogram
+	AlgorithmSEH = "seh"
+	// AlgorithmDDSketch is a relative error sketch with log-linear bucket indexing
+	AlgorithmDDSketch = "ddsketch"
+	// AlgorithmExplicit counts values into user defined buckets
+	AlgorithmExplicit = "explicit"
+	// AlgorithmExact keeps a count for every distinct value
+	AlgorithmExact = "exact"
+
+	defaultRelativeAccuracy = 0.01
+)
+
+var ErrInvalidStatisticSet = errors.New("invalid statistic set")
+
+// Options control how a Histogram reduces its values into the emitted distribution
+type Options struct {
+	// Algorithm is one of the Algorithm constants, defaults to AlgorithmSEH
+	Algorithm string
+	// RelativeAccuracy bounds the relative error of AlgorithmDDSketch values, defaults to 0.01
+	RelativeAccuracy float64
+	// Boundaries are the ascending, inclusive upper bounds of the AlgorithmExplicit buckets
+	Boundaries []float64
+	// BucketMeans emits each exponential bucket at the mean of the values that fell into it
+	// instead of the bucket's geometric midpoint
+	BucketMeans bool
+	// SignificantDigits rounds emitted values to this many significant digits, 0 disables rounding
+	SignificantDigits int
+}
+
+// Algorithm summarises the values added to a Histogram; every implementation reduces
+// to the same HistogramStats so the emitted EMF doesn't depend on the choice
+type Algorithm interface {
+	// Add fails with ErrCountOverflow, leaving the state untouched, if a count would overflow
+	Add(value float64, count uint64) error
+	// Reduce returns nil when nothing has been added
+	Reduce() *HistogramStats
+	// Merge fails when other is a different algorithm or was configured differently
+	Merge(other Algorithm) error
+
+	encoding.BinaryMarshaler
+	json.Marshaler
+}
+
+// Histogram tracks the exact min, max, sum and count of everything added alongside the
+// algorithm's distribution, so inputs the algorithm can only approximate, like statistic
+// sets, don't change the emitted statistics
 type Histogram struct {
-	// internal
-	values []float64
-	counts []uint
+	significantDigits int
+	algorithm         Algorithm
+
+	count uint64
+	sum   compensatedSum
+	min   float64
+	max   float64
 }
 
 type HistogramStats struct {
 	Values []float64 `json:"Values"`
-	Counts []uint    `json:"Counts"`
+	Counts []uint64  `json:"Counts"`
 	Min    float64   `json:"Min"`
 	Max    float64   `json:"Max"`
 	Sum    float64   `json:"Sum"`
 }
 
-func NewHistogram() *Histogram {
+// NewHistogram creates a histogram using the algorithm named in options
+// options are expected to have been checked with Validate, unknown algorithms fall back to SEH
+func NewHistogram(options Options) *Histogram {
 	return &Histogram{
-		values: make([]float64, 0),
-		counts: make([]uint, 0),
+		significantDigits: options.SignificantDigits,
+		algorithm:         newAlgorithm(options),
+		min:               math.MaxFloat64,
+		max:               -math.MaxFloat64,
 	}
 }
 
-func (va *Histogram) Add(value float64, count uint) {
-	for i := 0; i < len(va.values); i++ {
-		if va.values[i] == value {
-			va.counts[i] += count
-			return
+func newAlgorithm(options Options) Algorithm {
+	switch options.Algorithm {
+	case AlgorithmDDSketch:
+		relativeAccuracy := options.RelativeAccuracy
+		if relativeAccuracy == 0 {
+			relativeAccuracy = defaultRelativeAccuracy
 		}
+		return newDDSketch(relativeAccuracy)
+	case AlgorithmExplicit:
+		return newExplicitBuckets(options.Boundaries)
+	case AlgorithmExact:
+		return newExactAlgorithm()
+	default:
+		return newSEHAlgorithm(options.BucketMeans)
 	}
-	va.values = append(va.values, value)
-	va.counts = append(va.counts, count)
 }
 
-func (va *Histogram) Reduce() *HistogramStats {
-	switch len(va.values) {
-	case 0:
+func (va *Histogram) Add(value float64, count uint64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) || count == 0 {
 		return nil
-	case 1:
-		return &HistogramStats{
-			Values: []float64{va.values[0]},
-			Counts: []uint{va.counts[0]},
-			Min:    va.values[0],
-			Max:    va.values[0],
-			Sum:    float64(va.values[0]) * float64(va.counts[0]),
-		}
-	case 2:
-		return &HistogramStats{
-			Values: []float64{va.values[0], va.values[1]},
-			Counts: []uint{va.counts[0], va.counts[1]},
-			Min:    utils.Min(va.values[0], va.values[1]),
-			Max:    utils.Max(va.values[0], va.values[1]),
-			Sum:    float64(va.values[0])*float64(va.counts[0]) + float64(va.values[1])*float64(va.counts[1]),
+	}
+	// the algorithms never hold more than the total, so they can't overflow if it doesn't
+	total, err := addCount(va.count, count)
+	if err != nil {
+		return err
+	}
+	if err := va.algorithm.Add(value, count); err != nil {
+		return err
+	}
+	va.count = total
+	va.sum.AddProduct(value, count)
+	va.min = math.Min(va.min, value)
+	va.max = math.Max(va.max, value)
+	return nil
+}
+
+// AddStatisticSet adds a pre-aggregated {Min, Max, Sum, Count} set. The exact statistics are
+// kept as is while the algorithm is given an approximation of the distribution: one value at
+// each of min and max with the remaining count at the mean of what's left
+func (va *Histogram) AddStatisticSet(min float64, max float64, sum float64, count uint64) error {
+	if count == 0 {
+		return nil
+	}
+	for _, v := range []float64{min, max, sum} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%w: non finite value %v", ErrInvalidStatisticSet, v)
 		}
+	}
+	if min > max {
+		return fmt.Errorf("%w: min %v is greater than max %v", ErrInvalidStatisticSet, min, max)
+	}
+	total, err := addCount(va.count, count)
+	if err != nil {
+		return err
+	}
+
+	// none of these can fail since the total was checked above
+	switch {
+	case min == max:
+		_ = va.algorithm.Add(min, count)
+	case count == 1:
+		_ = va.algorithm.Add(math.Max(min, math.Min(max, sum)), 1)
 	default:
-		histogram := NewExponentialHistogram()
-		for i := range va.values {
-			histogram.Add(va.values[i], va.counts[i])
+		_ = va.algorithm.Add(min, 1)
+		_ = va.algorithm.Add(max, 1)
+		if rest := count - 2; rest > 0 {
+			mean := (sum - min - max) / float64(rest)
+			_ = va.algorithm.Add(math.Max(min, math.Min(max, mean)), rest)
 		}
-		if histogram.max == histogram.min {
-			return &HistogramStats{
-				Values: []float64{histogram.min},
-				Counts: []uint{histogram.count},
-				Min:    histogram.min,
-				Max:    histogram.max,
-				Sum:    histogram.sum,
-			}
+	}
+
+	va.count = total
+	va.sum.Add(sum)
+	va.min = math.Min(va.min, min)
+	va.max = math.Max(va.max, max)
+	return nil
+}
+
+// AddDistribution adds already bucketed values along with the exact min, max and sum they
+// were bucketed from, so re-aggregating aggregated EMF never widens or shifts the statistics.
+// Values are clamped to [min, max] since upstream bucket representatives can fall outside it
+func (va *Histogram) AddDistribution(values []float64, counts []uint64, min float64, max float64, sum float64) error {
+	if len(values) != len(counts) {
+		return fmt.Errorf("%w: %d values but %d counts", ErrInvalidStatisticSet, len(values), len(counts))
+	}
+	for _, v := range []float64{min, max, sum} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%w: non finite value %v", ErrInvalidStatisticSet, v)
 		}
-		buckets := histogram.GetNonEmptyBuckets()
-		values := make([]float64, len(buckets))
-		counts := make([]uint, len(buckets))
-		for i := range buckets {
-			values[i] = buckets[i].Value
-			counts[i] = buckets[i].Count
+	}
+	if min > max {
+		return fmt.Errorf("%w: min %v is greater than max %v", ErrInvalidStatisticSet, min, max)
+	}
+	count := uint64(0)
+	for i := range values {
+		if math.IsNaN(values[i]) || math.IsInf(values[i], 0) {
+			continue
+		}
+		var err error
+		if count, err = addCount(count, counts[i]); err != nil {
+			return err
 		}
-		return &HistogramStats{
-			Values: values,
-			Counts: counts,
-			Min:    histogram.min,
-			Max:    histogram.max,
-			Sum:    histogram.sum,
+	}
+	if count == 0 {
+		return nil
+	}
+	total, err := addCount(va.count, count)
+	if err != nil {
+		return err
+	}
+
+	// none of these can fail since the total was checked above
+	for i := range values {
+		if math.IsNaN(values[i]) || math.IsInf(values[i], 0) {
+			continue
+		}
+		_ = va.algorithm.Add(math.Max(min, math.Min(max, values[i])), counts[i])
+	}
+
+	va.count = total
+	va.sum.Add(sum)
+	va.min = math.Min(va.min, min)
+	va.max = math.Max(va.max, max)
+	return nil
+}
+
+// Merge combines another histogram into this one
+func (va *Histogram) Merge(other *Histogram) error {
+	total, err := addCount(va.count, other.count)
+	if err != nil {
+		return err
+	}
+	if err := va.algorithm.Merge(other.algorithm); err != nil {
+		return err
+	}
+	va.count = total
+	va.sum.Merge(other.sum)
+	va.min = math.Min(va.min, other.min)
+	va.max = math.Max(va.max, other.max)
+	return nil
+}
+
+// Reduce returns the algorithm's distribution with the exact statistics, or nil if nothing was added
+func (va *Histogram) Reduce() *HistogramStats {
+	stats := va.algorithm.Reduce()
+	if stats == nil {
+		return nil
+	}
+	stats.Min = va.min
+	stats.Max = va.max
+	stats.Sum = va.sum.Value()
+	if va.significantDigits > 0 {
+		stats.Values, stats.Counts = roundValues(stats.Values, stats.Counts, va.significantDigits)
+	}
+	return stats
+}
+
+// roundValues rounds each value to the given number of significant digits, combining
+// the counts of values that become equal so the emitted payload shrinks
+func roundValues(values []float64, counts []uint64, digits int) ([]float64, []uint64) {
+	roundedValues := make([]float64, 0, len(values))
+	roundedCounts := make([]uint64, 0, len(counts))
+	// index of each rounded value in roundedValues
+	indexes := make(map[float64]int, len(values))
+	for i := range values {
+		rounded := utils.RoundToSignificantDigits(values[i], digits)
+		if index, exists := indexes[rounded]; exists {
+			roundedCounts[index] = saturatingAdd(roundedCounts[index], counts[i])
+		} else {
+			indexes[rounded] = len(roundedValues)
+			roundedValues = append(roundedValues, rounded)
+			roundedCounts = append(roundedCounts, counts[i])
 		}
 	}
+	return roundedValues, roundedCounts
 }
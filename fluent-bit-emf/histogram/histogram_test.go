@@ -0,0 +1,154 @@
+package histogram
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestReduceSignificantDigits(t *testing.T) {
+	h := NewHistogram(Options{SignificantDigits: 2})
+	h.Add(1201, 1)
+	h.Add(1199, 2)
+
+	stats := h.Reduce()
+
+	// rounding to 2 digits collapses both values into 1200
+	if !reflect.DeepEqual(stats.Values, []float64{1200}) {
+		t.Errorf("Expected values [1200], got %v", stats.Values)
+	}
+	if !reflect.DeepEqual(stats.Counts, []uint64{3}) {
+		t.Errorf("Expected counts [3], got %v", stats.Counts)
+	}
+	if stats.Min != 1199 || stats.Max != 1201 || stats.Sum != 3599 {
+		t.Errorf("Expected exact min/max/sum to be kept, got %v/%v/%v", stats.Min, stats.Max, stats.Sum)
+	}
+}
+
+func TestAddStatisticSet(t *testing.T) {
+	for _, options := range []Options{
+		{Algorithm: AlgorithmSEH},
+		{Algorithm: AlgorithmExact},
+		{Algorithm: AlgorithmDDSketch},
+		{Algorithm: AlgorithmExplicit, Boundaries: []float64{10, 100}},
+	} {
+		t.Run(options.Algorithm, func(t *testing.T) {
+			h := NewHistogram(options)
+			if err := h.AddStatisticSet(1, 200, 1000, 10); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if err := h.Add(50, 2); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			stats := h.Reduce()
+			if stats.Min != 1 || stats.Max != 200 || stats.Sum != 1100 {
+				t.Errorf("Expected exact min 1, max 200 and sum 1100, got %v/%v/%v", stats.Min, stats.Max, stats.Sum)
+			}
+			total := uint64(0)
+			for _, count := range stats.Counts {
+				total += count
+			}
+			if total != 12 {
+				t.Errorf("Expected a total count of 12, got %d", total)
+			}
+			for _, value := range stats.Values {
+				if value < stats.Min || value > stats.Max {
+					t.Errorf("Expected values within [%v, %v], got %v", stats.Min, stats.Max, stats.Values)
+				}
+			}
+		})
+	}
+}
+
+func TestAddStatisticSetShapes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		min      float64
+		max      float64
+		sum      float64
+		count    uint64
+		expected *HistogramStats
+	}{
+		{
+			name: "Constant", min: 5, max: 5, sum: 50, count: 10,
+			expected: &HistogramStats{Values: []float64{5}, Counts: []uint64{10}, Min: 5, Max: 5, Sum: 50},
+		},
+		{
+			name: "Single", min: 3, max: 3, sum: 3, count: 1,
+			expected: &HistogramStats{Values: []float64{3}, Counts: []uint64{1}, Min: 3, Max: 3, Sum: 3},
+		},
+		{
+			name: "Pair", min: 1, max: 3, sum: 4, count: 2,
+			expected: &HistogramStats{Values: []float64{1, 3}, Counts: []uint64{1, 1}, Min: 1, Max: 3, Sum: 4},
+		},
+		{
+			name: "Spread", min: 0, max: 10, sum: 30, count: 6,
+			expected: &HistogramStats{Values: []float64{0, 10, 5}, Counts: []uint64{1, 1, 4}, Min: 0, Max: 10, Sum: 30},
+		},
+		{
+			// the mean of the rest would be below min, so it's clamped while the exact sum is kept
+			name: "Inconsistent sum", min: 2, max: 4, sum: 6, count: 4,
+			expected: &HistogramStats{Values: []float64{2, 4}, Counts: []uint64{3, 1}, Min: 2, Max: 4, Sum: 6},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHistogram(Options{Algorithm: AlgorithmExact})
+			if err := h.AddStatisticSet(tc.min, tc.max, tc.sum, tc.count); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if stats := h.Reduce(); !reflect.DeepEqual(stats, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, stats)
+			}
+		})
+	}
+}
+
+func TestAddStatisticSetInvalid(t *testing.T) {
+	h := NewHistogram(Options{})
+	if err := h.AddStatisticSet(2, 1, 3, 2); !errors.Is(err, ErrInvalidStatisticSet) {
+		t.Errorf("Expected %v, got %v", ErrInvalidStatisticSet, err)
+	}
+	if err := h.AddStatisticSet(math.NaN(), 1, 3, 2); !errors.Is(err, ErrInvalidStatisticSet) {
+		t.Errorf("Expected %v, got %v", ErrInvalidStatisticSet, err)
+	}
+	if stats := h.Reduce(); stats != nil {
+		t.Errorf("Expected nothing to be added, got %+v", stats)
+	}
+}
+
+func TestAddDistribution(t *testing.T) {
+	h := NewHistogram(Options{Algorithm: AlgorithmExact})
+	// bucket representatives from an upstream aggregator, 0.95 is below the real min
+	if err := h.AddDistribution([]float64{0.95, 2, 3}, []uint64{2, 1, 1}, 1, 3.5, 8.25); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// re-aggregating the same distribution again must not move the statistics
+	if err := h.AddDistribution([]float64{0.95, 2, 3}, []uint64{2, 1, 1}, 1, 3.5, 8.25); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := &HistogramStats{Values: []float64{1, 2, 3}, Counts: []uint64{4, 2, 2}, Min: 1, Max: 3.5, Sum: 16.5}
+	if stats := h.Reduce(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestAddDistributionInvalid(t *testing.T) {
+	h := NewHistogram(Options{})
+	if err := h.AddDistribution([]float64{1, 2}, []uint64{1}, 1, 2, 3); !errors.Is(err, ErrInvalidStatisticSet) {
+		t.Errorf("Expected %v, got %v", ErrInvalidStatisticSet, err)
+	}
+	if err := h.AddDistribution([]float64{1}, []uint64{1}, 2, 1, 1); !errors.Is(err, ErrInvalidStatisticSet) {
+		t.Errorf("Expected %v, got %v", ErrInvalidStatisticSet, err)
+	}
+	if err := h.AddDistribution([]float64{1, 2}, []uint64{math.MaxUint64, 1}, 1, 2, 3); !errors.Is(err, ErrCountOverflow) {
+		t.Errorf("Expected %v, got %v", ErrCountOverflow, err)
+	}
+	if stats := h.Reduce(); stats != nil {
+		t.Errorf("Expected nothing to be added, got %+v", stats)
+	}
+}
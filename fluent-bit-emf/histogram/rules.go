@@ -0,0 +1,112 @@
+package histogram
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// Rule selects the algorithm used for metrics whose namespace and name match its globs
+type Rule struct {
+	Namespace        string
+	Metric           string
+	Algorithm        string
+	RelativeAccuracy float64
+	Boundaries       []float64
+}
+
+// Rules are evaluated in order, the first matching rule wins
+type Rules []Rule
+
+// Options returns base with the algorithm of the first rule matching the metric applied
+func (rules Rules) Options(namespace string, metric string, base Options) Options {
+	for _, rule := range rules {
+		if utils.GlobMatch(rule.Namespace, namespace) && utils.GlobMatch(rule.Metric, metric) {
+			base.Algorithm = rule.Algorithm
+			base.RelativeAccuracy = rule.RelativeAccuracy
+			base.Boundaries = rule.Boundaries
+			break
+		}
+	}
+	return base
+}
+
+// Validate checks the algorithm and its parameters are usable
+func (o Options) Validate() error {
+	switch o.Algorithm {
+	case "", AlgorithmSEH, AlgorithmExact:
+		return nil
+	case AlgorithmDDSketch:
+		if o.RelativeAccuracy != 0 && !(o.RelativeAccuracy > 0 && o.RelativeAccuracy < 1) {
+			return fmt.Errorf("ddsketch relative accuracy must be between 0 and 1, was %v", o.RelativeAccuracy)
+		}
+		return nil
+	case AlgorithmExplicit:
+		if len(o.Boundaries) == 0 {
+			return fmt.Errorf("explicit buckets need at least one boundary")
+		}
+		if err := checkBoundaries(o.Boundaries); err != nil {
+			return fmt.Errorf("explicit bucket %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown histogram algorithm %q", o.Algorithm)
+	}
+}
+
+// ParseRules parses rules of the form `<namespace glob> <metric glob> <algorithm>[:params]`
+// separated by `;`, e.g.
+//
+//	MyService Latency ddsketch:0.02; * RequestSize explicit:100,1000,10000; * StatusCode exact
+//
+// ddsketch takes an optional relative accuracy and explicit takes its bucket boundaries
+func ParseRules(value string) (Rules, error) {
+	rules := make(Rules, 0)
+	for _, raw := range strings.Split(value, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		fields := strings.Fields(raw)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("histogram rule %q should be `<namespace> <metric> <algorithm>`", raw)
+		}
+
+		rule := Rule{Namespace: fields[0], Metric: fields[1]}
+		// anything after the metric is the algorithm spec, allowing spaces between boundaries
+		algorithm, params, _ := strings.Cut(strings.Join(fields[2:], ""), ":")
+		rule.Algorithm = strings.ToLower(algorithm)
+
+		switch rule.Algorithm {
+		case AlgorithmDDSketch:
+			if params != "" {
+				accuracy, err := strconv.ParseFloat(params, 64)
+				if err != nil {
+					return nil, fmt.Errorf("histogram rule %q has an invalid relative accuracy: %w", raw, err)
+				}
+				rule.RelativeAccuracy = accuracy
+			}
+		case AlgorithmExplicit:
+			for _, boundary := range strings.Split(params, ",") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(boundary), 64)
+				if err != nil {
+					return nil, fmt.Errorf("histogram rule %q has an invalid boundary: %w", raw, err)
+				}
+				rule.Boundaries = append(rule.Boundaries, parsed)
+			}
+		default:
+			if params != "" {
+				return nil, fmt.Errorf("histogram rule %q: %s takes no parameters", raw, rule.Algorithm)
+			}
+		}
+
+		options := Options{Algorithm: rule.Algorithm, RelativeAccuracy: rule.RelativeAccuracy, Boundaries: rule.Boundaries}
+		if err := options.Validate(); err != nil {
+			return nil, fmt.Errorf("histogram rule %q: %w", raw, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -1,12 +1,81 @@
 package histogram
 
-import "math"
+import (
+	"fmt"
+	"math"
+)
+
+// sehAlgorithm keeps the exact values while there are only a couple of distinct ones,
+// reducing anything larger through a sparse exponential histogram
+type sehAlgorithm struct {
+	exact       *exactAlgorithm
+	bucketMeans bool
+}
+
+func newSEHAlgorithm(bucketMeans bool) *sehAlgorithm {
+	return &sehAlgorithm{
+		exact:       newExactAlgorithm(),
+		bucketMeans: bucketMeans,
+	}
+}
+
+func (s *sehAlgorithm) Add(value float64, count uint64) error {
+	return s.exact.Add(value, count)
+}
+
+func (s *sehAlgorithm) Merge(other Algorithm) error {
+	o, ok := other.(*sehAlgorithm)
+	if !ok {
+		return fmt.Errorf("%w: can't merge %T into %s", ErrIncompatibleAlgorithm, other, AlgorithmSEH)
+	}
+	return s.exact.merge(o.exact)
+}
+
+func (s *sehAlgorithm) Reduce() *HistogramStats {
+	if len(s.exact.values) <= 2 {
+		return s.exact.Reduce()
+	}
+	histogram := NewExponentialHistogram(s.bucketMeans)
+	for i := range s.exact.values {
+		if err := histogram.Add(s.exact.values[i], s.exact.counts[i]); err != nil {
+			// the total no longer fits in a count, the exact values are still correct though
+			return s.exact.Reduce()
+		}
+	}
+	if histogram.max == histogram.min {
+		return &HistogramStats{
+			Values: []float64{histogram.min},
+			Counts: []uint64{histogram.count},
+			Min:    histogram.min,
+			Max:    histogram.max,
+			Sum:    histogram.Sum(),
+		}
+	}
+	buckets := histogram.GetNonEmptyBuckets()
+	values := make([]float64, len(buckets))
+	counts := make([]uint64, len(buckets))
+	for i := range buckets {
+		values[i] = buckets[i].Value
+		counts[i] = buckets[i].Count
+	}
+	return &HistogramStats{
+		Values: values,
+		Counts: counts,
+		Min:    histogram.min,
+		Max:    histogram.max,
+		Sum:    histogram.Sum(),
+	}
+}
 
 type exponentialHistogram struct {
-	buckets map[int]uint
+	// version of the bucketing scheme this sketch was built with, see bucketingVersion
+	version uint8
+	buckets map[int]uint64
+	// per bucket sum of the values added, only tracked when bucket means are requested
+	sums    map[int]*compensatedSum
 	binSize float64
-	count   uint
-	sum     float64 // New sum field
+	count   uint64
+	sum     compensatedSum
 	min     float64
 	max     float64
 }
@@ -17,15 +86,21 @@ const (
 
 type histogramBucket struct {
 	Value float64
-	Count uint
+	Count uint64
 }
 
 // NewExponentialHistogram creates a new histogram with exponential buckets
-func NewExponentialHistogram() *exponentialHistogram {
+// when trackBucketMeans is set each bucket also keeps the sum of its values so it can be reported at their mean
+func NewExponentialHistogram(trackBucketMeans bool) *exponentialHistogram {
+	var sums map[int]*compensatedSum
+	if trackBucketMeans {
+		sums = make(map[int]*compensatedSum)
+	}
 	return &exponentialHistogram{
-		buckets: make(map[int]uint),
+		version: bucketingVersion,
+		sums:    sums,
+		buckets: make(map[int]uint64),
 		binSize: math.Log(1 + epsilon),
-		sum:     0,
 		min:     math.MaxFloat64,
 		max:     -math.MaxFloat64,
 	}
@@ -44,8 +119,17 @@ func (h *exponentialHistogram) ValueOf(bucket int) float64 {
 	return math.Exp((float64(bucket) + 0.5) * h.binSize)
 }
 
+// representativeOf returns the value a bucket is reported at; the mean of the values
+// that fell into it when tracked, otherwise the bucket's geometric midpoint
+func (h *exponentialHistogram) representativeOf(bucket int) float64 {
+	if h.sums != nil && h.buckets[bucket] > 0 {
+		return h.sums[bucket].Value() / float64(h.buckets[bucket])
+	}
+	return h.ValueOf(bucket)
+}
+
 // GetBucketCount returns the count for a specific bucket
-func (h *exponentialHistogram) GetBucketCount(bucket int) uint {
+func (h *exponentialHistogram) GetBucketCount(bucket int) uint64 {
 	return h.buckets[bucket]
 }
 
@@ -54,22 +138,33 @@ func (h *exponentialHistogram) GetNonEmptyBuckets() []histogramBucket {
 	result := make([]histogramBucket, 0)
 	for bucket, count := range h.buckets {
 		if count > 0 {
-			result = append(result, histogramBucket{Value: h.ValueOf(bucket), Count: count})
+			result = append(result, histogramBucket{Value: h.representativeOf(bucket), Count: count})
 		}
 	}
 	return result
 }
 
 // Add adds a value to the histogram
-func (h *exponentialHistogram) Add(value float64, count uint) {
+func (h *exponentialHistogram) Add(value float64, count uint64) error {
 	if math.IsNaN(value) || math.IsInf(value, 0) {
-		return
+		return nil
+	}
+	// no bucket can overflow unless the total does
+	total, err := addCount(h.count, count)
+	if err != nil {
+		return err
 	}
 
 	bucket := h.getBucketIndex(value)
 	h.buckets[bucket] += count
-	h.count += count
-	h.sum += (value * float64(count)) // Add to sum
+	if h.sums != nil {
+		if h.sums[bucket] == nil {
+			h.sums[bucket] = &compensatedSum{}
+		}
+		h.sums[bucket].AddProduct(value, count)
+	}
+	h.count = total
+	h.sum.AddProduct(value, count)
 
 	if value < h.min {
 		h.min = value
@@ -77,11 +172,12 @@ func (h *exponentialHistogram) Add(value float64, count uint) {
 	if value > h.max {
 		h.max = value
 	}
+	return nil
 }
 
 // Sum returns the sum of all values added
 func (h *exponentialHistogram) Sum() float64 {
-	return h.sum
+	return h.sum.Value()
 }
 
 // Mean returns the arithmetic mean of all values
@@ -89,20 +185,40 @@ func (h *exponentialHistogram) Mean() float64 {
 	if h.count == 0 {
 		return 0
 	}
-	return h.sum / float64(h.count)
+	return h.Sum() / float64(h.count)
 }
 
 // Merge combines another histogram into this one
-func (h *exponentialHistogram) Merge(other *exponentialHistogram) {
+// histograms built with a different version or bin size can't be combined
+// since their bucket indexes don't line up
+func (h *exponentialHistogram) Merge(other *exponentialHistogram) error {
+	if other.version != h.version {
+		return fmt.Errorf("%w: %d != %d", ErrIncompatibleVersion, other.version, h.version)
+	}
 	if other.binSize != h.binSize {
-		return // Cannot merge histograms with different bases
+		return fmt.Errorf("%w: bin size %v != %v", ErrIncompatibleScale, other.binSize, h.binSize)
+	}
+	if (h.sums == nil) != (other.sums == nil) {
+		return fmt.Errorf("%w: only one histogram tracks bucket means", ErrIncompatibleOptions)
+	}
+
+	total, err := addCount(h.count, other.count)
+	if err != nil {
+		return err
 	}
 
 	for bucket, count := range other.buckets {
 		h.buckets[bucket] += count
 	}
-	h.count += other.count
-	h.sum += other.sum // Add the sums
+	for bucket, sum := range other.sums {
+		if h.sums[bucket] == nil {
+			h.sums[bucket] = &compensatedSum{}
+		}
+		h.sums[bucket].Merge(*sum)
+	}
+	h.count = total
+	h.sum.Merge(other.sum)
 	h.min = math.Min(h.min, other.min)
 	h.max = math.Max(h.max, other.max)
+	return nil
 }
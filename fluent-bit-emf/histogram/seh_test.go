@@ -1,12 +1,13 @@
 package histogram
 
 import (
+	"errors"
 	"math"
 	"testing"
 )
 
 func TestNewExponentialHistogram(t *testing.T) {
-	h := NewExponentialHistogram()
+	h := NewExponentialHistogram(false)
 
 	if h.binSize != math.Log(1+epsilon) {
 		t.Errorf("Expected binSize %v, got %v", math.Log(1+epsilon), h.binSize)
@@ -16,18 +17,18 @@ func TestNewExponentialHistogram(t *testing.T) {
 		t.Errorf("Expected initial count 0, got %v", h.count)
 	}
 
-	if h.sum != 0 {
-		t.Errorf("Expected initial sum 0, got %v", h.sum)
+	if h.Sum() != 0 {
+		t.Errorf("Expected initial sum 0, got %v", h.Sum())
 	}
 }
 
 func TestAdd(t *testing.T) {
-	h := NewExponentialHistogram()
+	h := NewExponentialHistogram(false)
 
 	testCases := []struct {
 		value    float64
-		count    uint
-		expected uint
+		count    uint64
+		expected uint64
 	}{
 		{1.0, 1, 1},
 		{2.0, 2, 2},
@@ -47,7 +48,7 @@ func TestAdd(t *testing.T) {
 }
 
 func TestMinMax(t *testing.T) {
-	h := NewExponentialHistogram()
+	h := NewExponentialHistogram(false)
 
 	h.Add(1.0, 1)
 	h.Add(2.0, 1)
@@ -63,7 +64,7 @@ func TestMinMax(t *testing.T) {
 }
 
 func TestMean(t *testing.T) {
-	h := NewExponentialHistogram()
+	h := NewExponentialHistogram(false)
 
 	// Test empty histogram
 	if mean := h.Mean(); mean != 0 {
@@ -81,29 +82,31 @@ func TestMean(t *testing.T) {
 }
 
 func TestMerge(t *testing.T) {
-	h1 := NewExponentialHistogram()
-	h2 := NewExponentialHistogram()
+	h1 := NewExponentialHistogram(false)
+	h2 := NewExponentialHistogram(false)
 
 	h1.Add(1.0, 1)
 	h1.Add(2.0, 1)
 	h2.Add(3.0, 1)
 	h2.Add(4.0, 1)
 
-	h1.Merge(h2)
+	if err := h1.Merge(h2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
 
-	expectedCount := uint(4)
+	expectedCount := uint64(4)
 	if h1.count != expectedCount {
 		t.Errorf("Expected merged count %v, got %v", expectedCount, h1.count)
 	}
 
 	expectedSum := 10.0 // 1 + 2 + 3 + 4
-	if math.Abs(h1.sum-expectedSum) > 1e-10 {
-		t.Errorf("Expected merged sum %v, got %v", expectedSum, h1.sum)
+	if math.Abs(h1.Sum()-expectedSum) > 1e-10 {
+		t.Errorf("Expected merged sum %v, got %v", expectedSum, h1.Sum())
 	}
 }
 
 func TestGetNonEmptyBuckets(t *testing.T) {
-	h := NewExponentialHistogram()
+	h := NewExponentialHistogram(false)
 
 	h.Add(1.0, 1)
 	h.Add(2.0, 2)
@@ -121,3 +124,32 @@ func TestGetNonEmptyBuckets(t *testing.T) {
 		}
 	}
 }
+
+func TestBucketMeans(t *testing.T) {
+	h := NewExponentialHistogram(true)
+
+	// both values land in the same bucket, which is reported at their mean rather than its midpoint
+	h.Add(100, 1)
+	h.Add(101, 3)
+
+	buckets := h.GetNonEmptyBuckets()
+	if len(buckets) != 1 {
+		t.Fatalf("Expected 1 bucket, got %d", len(buckets))
+	}
+
+	expected := (100.0 + 3*101.0) / 4
+	if math.Abs(buckets[0].Value-expected) > 1e-10 {
+		t.Errorf("Expected bucket value %v, got %v", expected, buckets[0].Value)
+	}
+
+	midpoint := NewExponentialHistogram(false)
+	midpoint.Add(100, 1)
+	midpoint.Add(101, 3)
+	if value := midpoint.GetNonEmptyBuckets()[0].Value; value == expected {
+		t.Errorf("Expected geometric midpoint without bucket means, got %v", value)
+	}
+
+	if err := h.Merge(midpoint); !errors.Is(err, ErrIncompatibleOptions) {
+		t.Errorf("Expected %v, got %v", ErrIncompatibleOptions, err)
+	}
+}
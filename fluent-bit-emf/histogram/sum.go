@@ -0,0 +1,77 @@
+package histogram
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+var ErrCountOverflow = errors.New("histogram count overflow")
+
+// compensatedSum accumulates float64 values with Neumaier's variant of Kahan summation,
+// tracking the low order bits lost by each addition so long running sums of small
+// increments don't drift
+type compensatedSum struct {
+	Sum          float64 `json:"sum"`
+	Compensation float64 `json:"compensation"`
+}
+
+func (s *compensatedSum) Add(value float64) {
+	t := s.Sum + value
+	if math.IsInf(t, 0) {
+		// the error terms are meaningless once the sum overflows, and would otherwise turn it into NaN
+		s.Sum = t
+		return
+	}
+	if math.Abs(s.Sum) >= math.Abs(value) {
+		s.Compensation += (s.Sum - t) + value
+	} else {
+		s.Compensation += (value - t) + s.Sum
+	}
+	s.Sum = t
+}
+
+// AddProduct adds value * count, compensating for the rounding error of the multiplication too
+func (s *compensatedSum) AddProduct(value float64, count uint64) {
+	// split count so both halves convert to float64 exactly
+	for _, part := range [2]uint64{count &^ 0xFFFFFFFF, count & 0xFFFFFFFF} {
+		if part == 0 {
+			continue
+		}
+		c := float64(part)
+		product := value * c
+		s.Add(product)
+		if !math.IsInf(product, 0) {
+			// fma recovers the exact rounding error of the multiplication
+			s.Add(math.FMA(value, c, -product))
+		}
+	}
+}
+
+func (s *compensatedSum) Merge(other compensatedSum) {
+	s.Add(other.Sum)
+	s.Add(other.Compensation)
+}
+
+func (s compensatedSum) Value() float64 {
+	return s.Sum + s.Compensation
+}
+
+// addCount adds two counts, failing rather than wrapping around on overflow
+func addCount(a uint64, b uint64) (uint64, error) {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return a, fmt.Errorf("%w: %d + %d", ErrCountOverflow, a, b)
+	}
+	return sum, nil
+}
+
+// saturatingAdd adds two counts, clamping at math.MaxUint64 instead of wrapping around
+func saturatingAdd(a uint64, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
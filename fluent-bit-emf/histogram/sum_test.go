@@ -0,0 +1,147 @@
+package histogram
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+)
+
+// bigSum is an exact reference for sums of value * count
+type bigSum struct {
+	sum *big.Float
+}
+
+func newBigSum() *bigSum {
+	return &bigSum{sum: new(big.Float).SetPrec(2048)}
+}
+
+func (b *bigSum) addProduct(value float64, count uint64) {
+	product := new(big.Float).SetPrec(2048).SetFloat64(value)
+	product.Mul(product, new(big.Float).SetPrec(2048).SetUint64(count))
+	b.sum.Add(b.sum, product)
+}
+
+func (b *bigSum) float64() float64 {
+	f, _ := b.sum.Float64()
+	return f
+}
+
+func TestCompensatedSumSmallIncrements(t *testing.T) {
+	var compensated compensatedSum
+	naive := 0.0
+	reference := newBigSum()
+
+	compensated.Add(1e16)
+	naive += 1e16
+	reference.addProduct(1e16, 1)
+	for i := 0; i < 100000; i++ {
+		compensated.Add(1.1)
+		naive += 1.1
+		reference.addProduct(1.1, 1)
+	}
+
+	expected := reference.float64()
+	if compensated.Value() != expected {
+		t.Errorf("Expected compensated sum %v, got %v", expected, compensated.Value())
+	}
+	if naive == expected {
+		t.Errorf("Expected naive summation to drift, this test no longer exercises compensation")
+	}
+}
+
+func TestCompensatedSumProducts(t *testing.T) {
+	var compensated compensatedSum
+	reference := newBigSum()
+
+	products := []struct {
+		value float64
+		count uint64
+	}{
+		{0.1, 1<<63 + 12345},
+		{-0.1, 1 << 63},
+		{1.0 / 3, math.MaxUint64},
+		{-1.0 / 3, math.MaxUint64 - 1},
+		{1e-9, 7},
+	}
+	for _, p := range products {
+		compensated.AddProduct(p.value, p.count)
+		reference.addProduct(p.value, p.count)
+	}
+
+	expected := reference.float64()
+	if relative := math.Abs(compensated.Value()-expected) / math.Abs(expected); relative > 1e-15 {
+		t.Errorf("Expected %v, got %v (relative error %v)", expected, compensated.Value(), relative)
+	}
+}
+
+func TestHistogramSumsMatchBigReference(t *testing.T) {
+	for _, options := range []Options{
+		{Algorithm: AlgorithmSEH},
+		{Algorithm: AlgorithmExact},
+		{Algorithm: AlgorithmDDSketch},
+		{Algorithm: AlgorithmExplicit, Boundaries: []float64{1, 1000}},
+	} {
+		t.Run(options.Algorithm, func(t *testing.T) {
+			h := NewHistogram(options)
+			reference := newBigSum()
+			counts := new(big.Int)
+
+			add := func(value float64, count uint64) {
+				if err := h.Add(value, count); err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				reference.addProduct(value, count)
+				counts.Add(counts, new(big.Int).SetUint64(count))
+			}
+			add(1e15, 1)
+			for i := 0; i < 1000; i++ {
+				add(0.01*float64(i%7+1), uint64(i%5+1))
+			}
+			add(3.3, 1<<40)
+
+			stats := h.Reduce()
+			if expected := reference.float64(); stats.Sum != expected {
+				t.Errorf("Expected sum %v, got %v", expected, stats.Sum)
+			}
+
+			total := new(big.Int)
+			for _, count := range stats.Counts {
+				total.Add(total, new(big.Int).SetUint64(count))
+			}
+			if total.Cmp(counts) != 0 {
+				t.Errorf("Expected total count %v, got %v", counts, total)
+			}
+		})
+	}
+}
+
+func TestCountOverflow(t *testing.T) {
+	for _, options := range []Options{
+		{Algorithm: AlgorithmSEH},
+		{Algorithm: AlgorithmExact},
+		{Algorithm: AlgorithmDDSketch},
+		{Algorithm: AlgorithmExplicit, Boundaries: []float64{1}},
+	} {
+		t.Run(options.Algorithm, func(t *testing.T) {
+			h := NewHistogram(options)
+			if err := h.Add(0.5, math.MaxUint64); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if err := h.Add(0.5, 1); !errors.Is(err, ErrCountOverflow) {
+				t.Errorf("Expected %v, got %v", ErrCountOverflow, err)
+			}
+
+			other := NewHistogram(options)
+			other.Add(0.5, 2)
+			if err := h.Merge(other); !errors.Is(err, ErrCountOverflow) {
+				t.Errorf("Expected %v, got %v", ErrCountOverflow, err)
+			}
+
+			// a failed add or merge must leave the state untouched
+			if stats := h.Reduce(); len(stats.Counts) != 1 || stats.Counts[0] != math.MaxUint64 {
+				t.Errorf("Expected a single count of %d, got %v", uint64(math.MaxUint64), stats.Counts)
+			}
+		})
+	}
+}
@@ -7,12 +7,18 @@ package main
 */
 import (
 	"C"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 	"unsafe"
 
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/common"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/dimension"
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/emf"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/histogram"
 	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/log"
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/metric"
 	"github.com/fluent/fluent-bit-go/output"
 )
 
@@ -48,6 +54,147 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 
 	options.AggregationPeriod = aggregationPeriod
 
+	if options.BucketMeans, err = parseBool(output.FLBPluginConfigKey(plugin, "bucket_means"), false); err != nil {
+		log.Error().Printf("invalid bucket_means: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	if digits := output.FLBPluginConfigKey(plugin, "significant_digits"); digits != "" {
+		if options.SignificantDigits, err = strconv.Atoi(digits); err != nil || options.SignificantDigits < 0 {
+			log.Error().Printf("invalid significant_digits %q, expected a non negative integer\n", digits)
+			return output.FLB_ERROR
+		}
+	}
+
+	if options.HistogramRules, err = histogram.ParseRules(output.FLBPluginConfigKey(plugin, "histogram_rules")); err != nil {
+		log.Error().Printf("invalid histogram_rules: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	if options.MetricRules, err = metric.ParseRules(output.FLBPluginConfigKey(plugin, "metric_rules")); err != nil {
+		log.Error().Printf("invalid metric_rules: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	if options.DimensionRules, err = dimension.ParseRules(output.FLBPluginConfigKey(plugin, "dimension_rules")); err != nil {
+		log.Error().Printf("invalid dimension_rules: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	if options.DimensionInjections, err = dimension.ParseInjections(output.FLBPluginConfigKey(plugin, "dimension_injections")); err != nil {
+		log.Error().Printf("invalid dimension_injections: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	switch options.InvalidValues = strings.ToLower(output.FLBPluginConfigKey(plugin, "invalid_values")); options.InvalidValues {
+	case "":
+		options.InvalidValues = common.InvalidValuesDropRecord
+	case common.InvalidValuesDropRecord, common.InvalidValuesDropMetric, common.InvalidValuesCoerce:
+	default:
+		log.Error().Printf("invalid invalid_values %q, expected %s, %s or %s\n", options.InvalidValues, common.InvalidValuesDropRecord, common.InvalidValuesDropMetric, common.InvalidValuesCoerce)
+		return output.FLB_ERROR
+	}
+
+	switch options.UnitConflicts = strings.ToLower(output.FLBPluginConfigKey(plugin, "unit_conflicts")); options.UnitConflicts {
+	case "":
+		options.UnitConflicts = common.UnitConflictsConvert
+	case common.UnitConflictsConvert, common.UnitConflictsSplit, common.UnitConflictsReject:
+	default:
+		log.Error().Printf("invalid unit_conflicts %q, expected %s, %s or %s\n", options.UnitConflicts, common.UnitConflictsConvert, common.UnitConflictsSplit, common.UnitConflictsReject)
+		return output.FLB_ERROR
+	}
+
+	switch options.TimestampUnit = strings.ToLower(output.FLBPluginConfigKey(plugin, "timestamp_unit")); options.TimestampUnit {
+	case "":
+		options.TimestampUnit = common.TimestampUnitAuto
+	case common.TimestampUnitAuto, common.TimestampUnitSeconds, common.TimestampUnitMilliseconds, common.TimestampUnitMicroseconds, common.TimestampUnitNanoseconds:
+	default:
+		log.Error().Printf("invalid timestamp_unit %q, expected auto, s, ms, us or ns\n", options.TimestampUnit)
+		return output.FLB_ERROR
+	}
+
+	// CloudWatch rejects events more than 14 days old or 2 hours in the future
+	if options.TimestampMaxPast, err = parseDuration(output.FLBPluginConfigKey(plugin, "timestamp_max_past"), 14*24*time.Hour); err != nil {
+		log.Error().Printf("invalid timestamp_max_past: %v\n", err)
+		return output.FLB_ERROR
+	}
+	if options.TimestampMaxFuture, err = parseDuration(output.FLBPluginConfigKey(plugin, "timestamp_max_future"), 2*time.Hour); err != nil {
+		log.Error().Printf("invalid timestamp_max_future: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	if options.DecomposeDimensionSets, err = parseBool(output.FLBPluginConfigKey(plugin, "decompose_dimension_sets"), false); err != nil {
+		log.Error().Printf("invalid decompose_dimension_sets: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	options.TagDimension = output.FLBPluginConfigKey(plugin, "tag_dimension")
+	if options.TagSeriesKey, err = parseBool(output.FLBPluginConfigKey(plugin, "tag_series_key"), false); err != nil {
+		log.Error().Printf("invalid tag_series_key: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	options.EmbeddedKeys = []string{"log", "message"}
+	if keys := output.FLBPluginConfigKey(plugin, "embedded_keys"); keys != "" {
+		options.EmbeddedKeys = strings.FieldsFunc(keys, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+
+	if dimensions := output.FLBPluginConfigKey(plugin, "drop_dimensions"); dimensions != "" {
+		options.DropDimensions = strings.FieldsFunc(dimensions, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+
+	options.DiagnosticSampleRate = 100
+	if rate := output.FLBPluginConfigKey(plugin, "diagnostic_sample_rate"); rate != "" {
+		if options.DiagnosticSampleRate, err = strconv.Atoi(rate); err != nil || options.DiagnosticSampleRate < 0 {
+			log.Error().Printf("invalid diagnostic_sample_rate %q, expected a non negative integer\n", rate)
+			return output.FLB_ERROR
+		}
+	}
+
+	options.DeadLetterPath = output.FLBPluginConfigKey(plugin, "dead_letter_path")
+	options.DeadLetterLogGroupName = output.FLBPluginConfigKey(plugin, "dead_letter_log_group_name")
+	options.DeadLetterLogStreamName = output.FLBPluginConfigKey(plugin, "dead_letter_log_stream_name")
+	for key, target := range map[string]*int{
+		"dead_letter_max_records":      &options.DeadLetterMaxRecords,
+		"dead_letter_max_record_bytes": &options.DeadLetterMaxRecordBytes,
+		"dead_letter_max_bytes":        &options.DeadLetterMaxBytes,
+	} {
+		if *target, err = parseLimit(output.FLBPluginConfigKey(plugin, key), deadLetterDefaults[key]); err != nil {
+			log.Error().Printf("invalid %s: %v\n", key, err)
+			return output.FLB_ERROR
+		}
+	}
+
+	for key, target := range map[string]*int{
+		"max_series":               &options.MaxSeries,
+		"max_series_per_namespace": &options.MaxSeriesPerNamespace,
+		"max_series_per_metric":    &options.MaxSeriesPerMetric,
+	} {
+		if *target, err = parseLimit(output.FLBPluginConfigKey(plugin, key), 0); err != nil {
+			log.Error().Printf("invalid %s: %v\n", key, err)
+			return output.FLB_ERROR
+		}
+	}
+
+	switch options.CardinalityOverflow = strings.ToLower(output.FLBPluginConfigKey(plugin, "cardinality_overflow")); options.CardinalityOverflow {
+	case "":
+		options.CardinalityOverflow = common.CardinalityOverflowFold
+	case common.CardinalityOverflowFold, common.CardinalityOverflowDrop:
+	default:
+		log.Error().Printf("invalid cardinality_overflow %q, expected %s or %s\n", options.CardinalityOverflow, common.CardinalityOverflowFold, common.CardinalityOverflowDrop)
+		return output.FLB_ERROR
+	}
+
+	if options.RetainedProperties, err = emf.ParseRetainedProperties(output.FLBPluginConfigKey(plugin, "retain_properties")); err != nil {
+		log.Error().Printf("invalid retain_properties: %v\n", err)
+		return output.FLB_ERROR
+	}
+
+	if options.Validation, err = emf.ParseValidation(output.FLBPluginConfigKey(plugin, "validation")); err != nil {
+		log.Error().Printf("invalid validation: %v\n", err)
+		return output.FLB_ERROR
+	}
+
 	aggregator, err := emf.NewEMFAggregator(&options)
 	if err != nil {
 		log.Info().Printf("failed to create EMFAggregator: %v\n", err)
@@ -70,19 +217,68 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	}()
 	aggregator := output.FLBPluginGetContext(ctx).(*emf.EMFAggregator)
 
-	aggregator.Aggregate(data, int(length))
+	aggregator.Aggregate(data, int(length), C.GoString(tag))
 
 	return output.FLB_OK
 }
 
 //export FLBPluginExitCtx
 func FLBPluginExitCtx(ctx unsafe.Pointer) int {
-	// perform a last flush before we are killed
-	// I don't think this actually works
+	// perform a last flush and release the destinations before we are killed
 	aggregator := output.FLBPluginGetContext(ctx).(*emf.EMFAggregator)
-	aggregator.Task.Stop()
+	if err := aggregator.Close(); err != nil {
+		log.Error().Printf("failed to close: %v\n", err)
+		return output.FLB_ERROR
+	}
 	return output.FLB_OK
 }
 
+// parseBool accepts the boolean spellings fluent-bit uses in its own configs
+func parseBool(value string, fallback bool) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return fallback, nil
+	case "true", "on", "yes", "1":
+		return true, nil
+	case "false", "off", "no", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expected a boolean, was %q", value)
+	}
+}
+
+var deadLetterDefaults = map[string]int{
+	"dead_letter_max_records":      100,
+	"dead_letter_max_record_bytes": 64 * 1024,
+	"dead_letter_max_bytes":        1024 * 1024,
+}
+
+// parseLimit reads a non negative integer with a fallback for unset keys
+func parseLimit(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("expected a non negative integer, was %q", value)
+	}
+	return limit, nil
+}
+
+// parseDuration is time.ParseDuration with a fallback for unset keys, negative durations are rejected
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("expected a non negative duration, was %q", value)
+	}
+	return duration, nil
+}
+
 func main() {
 }
@@ -0,0 +1,106 @@
+// Package metric drops, renames and moves metrics between namespaces before records are
+// aggregated, so producers don't have to be redeployed to clean up their metrics
+package metric
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anthonydresser/fluent-bit-emf-aggregator/fluent-bit-emf/utils"
+)
+
+// Rule actions
+const (
+	// ActionKeep stops evaluating rules for the metric
+	ActionKeep = "keep"
+	// ActionDrop removes the metric from the record
+	ActionDrop = "drop"
+	// ActionRename gives the metric a new name
+	ActionRename = "rename"
+	// ActionNamespace moves the metric to another namespace
+	ActionNamespace = "namespace"
+)
+
+// Rule applies its action to metrics whose namespace and name match
+type Rule struct {
+	Namespace utils.Matcher
+	Metric    utils.Matcher
+	Action    string
+	// Template is the new name or namespace, see ParseRules
+	Template string
+}
+
+// Rules are evaluated in order, renames and namespace changes apply to the rules after them
+// and keep and drop stop the evaluation
+type Rules []Rule
+
+// Apply returns the metric's namespace and name after the rules, false when it's dropped
+func (rules Rules) Apply(namespace string, name string) (string, string, bool) {
+	for _, rule := range rules {
+		if !rule.Namespace.Match(namespace) || !rule.Metric.Match(name) {
+			continue
+		}
+		switch rule.Action {
+		case ActionKeep:
+			return namespace, name, true
+		case ActionDrop:
+			return namespace, name, false
+		case ActionRename:
+			name = expand(rule.Metric.Expand(rule.Template, name), namespace, name)
+		case ActionNamespace:
+			namespace = expand(rule.Namespace.Expand(rule.Template, namespace), namespace, name)
+		}
+	}
+	return namespace, name, true
+}
+
+func expand(template string, namespace string, name string) string {
+	return strings.NewReplacer("{namespace}", namespace, "{name}", name).Replace(template)
+}
+
+// ParseRules parses rules of the form `<namespace> <metric> <action> [template]` separated by
+// `;`. Namespaces and metrics are exact names, globs or `/regex/` matching the whole name, e.g.
+//
+//	MyService /(.*)Latency/ rename $1.Latency; * Debug* drop; * * namespace prod/{namespace}
+//
+// rename and namespace take the new name or namespace, which can use {namespace} and {name}
+// for the current ones and $1 for the groups of a regular expression for the metric or
+// namespace respectively. Neither can contain spaces or `;`
+func ParseRules(value string) (Rules, error) {
+	rules := make(Rules, 0)
+	for _, raw := range strings.Split(value, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		fields := strings.Fields(raw)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("metric rule %q should be `<namespace> <metric> <action> [template]`", raw)
+		}
+
+		var rule Rule
+		var err error
+		if rule.Namespace, err = utils.ParseMatcher(fields[0]); err != nil {
+			return nil, fmt.Errorf("metric rule %q: %w", raw, err)
+		}
+		if rule.Metric, err = utils.ParseMatcher(fields[1]); err != nil {
+			return nil, fmt.Errorf("metric rule %q: %w", raw, err)
+		}
+		rule.Action = strings.ToLower(fields[2])
+		switch rule.Action {
+		case ActionKeep, ActionDrop:
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("metric rule %q: %s takes no parameters", raw, rule.Action)
+			}
+		case ActionRename, ActionNamespace:
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("metric rule %q: %s takes a template", raw, rule.Action)
+			}
+			rule.Template = fields[3]
+		default:
+			return nil, fmt.Errorf("metric rule %q has unknown action %q, expected keep, drop, rename or namespace", raw, fields[2])
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,43 @@
+package metric
+
+import "testing"
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("MyService /(.*)Latency/ rename $1.Latency; * Debug* drop; Internal * KEEP; /(.*)/ * namespace prod/$1; * Legacy rename {name}V2;")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rules) != 5 {
+		t.Fatalf("Expected 5 rules, got %+v", rules)
+	}
+
+	for _, tc := range []struct {
+		namespace, name                 string
+		expectedNamespace, expectedName string
+		keep                            bool
+	}{
+		{namespace: "MyService", name: "GetLatency", expectedNamespace: "prod/MyService", expectedName: "Get.Latency", keep: true},
+		{namespace: "Other", name: "GetLatency", expectedNamespace: "prod/Other", expectedName: "GetLatency", keep: true},
+		{namespace: "MyService", name: "DebugCounter", keep: false},
+		{namespace: "Internal", name: "Legacy", expectedNamespace: "Internal", expectedName: "Legacy", keep: true},
+		{namespace: "Other", name: "Legacy", expectedNamespace: "prod/Other", expectedName: "LegacyV2", keep: true},
+	} {
+		namespace, name, keep := rules.Apply(tc.namespace, tc.name)
+		if keep != tc.keep || (keep && (namespace != tc.expectedNamespace || name != tc.expectedName)) {
+			t.Errorf("%s %s: expected %s %s %v, got %s %s %v", tc.namespace, tc.name, tc.expectedNamespace, tc.expectedName, tc.keep, namespace, name, keep)
+		}
+	}
+
+	for _, invalid := range []string{
+		"* Latency",
+		"* Latency unknown",
+		"* Latency drop now",
+		"* Latency rename",
+		"* /(/ drop",
+		"/(/ * drop",
+	} {
+		if _, err := ParseRules(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -1,25 +1,147 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
-// Helper function to convert interface{} to float64
-func ConvertToFloat64(v interface{}) float64 {
+var ErrNotNumeric = errors.New("not a number")
+
+// ParseFloat64 converts every numeric type, booleans as 0/1, json.Number and numeric
+// strings to float64, anything else is an ErrNotNumeric error rather than a silent 0.
+// NaN and infinities, including strings like "NaN" and "+Inf", aren't numbers either
+func ParseFloat64(v interface{}) (float64, error) {
+	f, err := parseFloat64(v)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return 0, fmt.Errorf("%w: %v isn't finite", ErrNotNumeric, v)
+	}
+	return f, err
+}
+
+func parseFloat64(v interface{}) (float64, error) {
 	switch v := v.(type) {
 	case float64:
-		return v
+		return v, nil
 	case float32:
-		return float64(v)
+		return float64(v), nil
 	case int:
-		return float64(v)
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
 	case int64:
-		return float64(v)
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case json.Number:
+		return parseFloatString(string(v))
 	case string:
-		if f, err := strconv.ParseFloat(v, 64); err == nil {
-			return f
+		return parseFloatString(v)
+	case []byte:
+		return parseFloatString(string(v))
+	}
+	return 0, fmt.Errorf("%w: %v (%T)", ErrNotNumeric, v, v)
+}
+
+func parseFloatString(v string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrNotNumeric, v)
+	}
+	return f, nil
+}
+
+// ParseUint64 converts v to a count, integer types are converted directly so counts
+// above 2^53 don't lose precision going through float64. Negative and fractional
+// values are errors
+func ParseUint64(v interface{}) (uint64, error) {
+	switch v := v.(type) {
+	case uint64:
+		return v, nil
+	case uint32:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint:
+		return uint64(v), nil
+	case int, int8, int16, int32, int64:
+		i := reflect.ValueOf(v).Int()
+		if i < 0 {
+			return 0, fmt.Errorf("%w: negative count %d", ErrNotNumeric, i)
 		}
+		return uint64(i), nil
+	case json.Number:
+		return parseUintString(string(v))
+	case string:
+		return parseUintString(v)
+	case []byte:
+		return parseUintString(string(v))
+	}
+	f, err := ParseFloat64(v)
+	if err != nil {
+		return 0, err
+	}
+	return floatToCount(f)
+}
+
+func parseUintString(v string) (uint64, error) {
+	if u, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64); err == nil {
+		return u, nil
+	}
+	// lets "2.0" and "1e3" through as counts
+	f, err := parseFloatString(v)
+	if err != nil {
+		return 0, err
+	}
+	return floatToCount(f)
+}
+
+func floatToCount(f float64) (uint64, error) {
+	// 2^64 is exactly representable, anything at or above it isn't a uint64
+	if !(f >= 0 && f < math.MaxUint64) || f != math.Trunc(f) {
+		return 0, fmt.Errorf("%w: %v is not a valid count", ErrNotNumeric, f)
+	}
+	return uint64(f), nil
+}
+
+// ConvertToFloat64 is the coercing form of ParseFloat64, anything that isn't a number is 0
+func ConvertToFloat64(v interface{}) float64 {
+	f, _ := ParseFloat64(v)
+	return f
+}
+
+// ConvertToUint64 is the coercing form of ParseUint64, negative and non numeric values are 0
+// and fractional ones are truncated
+func ConvertToUint64(v interface{}) uint64 {
+	if u, err := ParseUint64(v); err == nil {
+		return u
+	}
+	if f := ConvertToFloat64(v); f > 0 && f < math.MaxUint64 {
+		return uint64(f)
 	}
 	return 0
 }
@@ -44,6 +166,46 @@ func Every[T any](array []T, test func(T) bool) bool {
 	return true
 }
 
+// RoundToSignificantDigits rounds v to the given number of significant digits
+// going through the decimal representation so the result has no binary noise, e.g. 0.1 rather than 0.10000000000000002
+func RoundToSignificantDigits(v float64, digits int) float64 {
+	if digits <= 0 || v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	if err != nil {
+		return v
+	}
+	return rounded
+}
+
+// GlobMatch reports whether s matches pattern, where `*` matches any run of characters
+// (including `/`, unlike path.Match, since namespaces commonly contain it) and `?` any single character
+func GlobMatch(pattern string, s string) bool {
+	p, i := 0, 0
+	// position to resume from if the most recent star needs to consume another character
+	starP, starI := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starI = p, i
+			p++
+		case starP != -1:
+			starI++
+			p, i = starP+1, starI
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
 func Min(a, b float64) float64 {
 	if a < b {
 		return a
@@ -69,3 +231,70 @@ func ToString(v interface{}) string {
 		return fmt.Sprintf("%v", v)
 	}
 }
+
+// ToJSONValue converts decoded msgpack, which has interface{} map keys and []byte strings, into
+// something encoding/json can marshal
+func ToJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			converted[ToString(key)] = ToJSONValue(val)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i := range v {
+			converted[i] = ToJSONValue(v[i])
+		}
+		return converted
+	case []byte:
+		return string(v)
+	default:
+		return v
+	}
+}
+
+// Matcher matches strings exactly, by glob or by regular expression
+type Matcher struct {
+	pattern string
+	regexp  *regexp.Regexp
+}
+
+// ParseMatcher parses `/regex/` as a regular expression that has to match the whole string,
+// anything else is a glob, which matches exactly when it has no wildcards
+func ParseMatcher(pattern string) (Matcher, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		compiled, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return Matcher{}, fmt.Errorf("invalid regular expression %s: %w", pattern, err)
+		}
+		return Matcher{pattern: pattern, regexp: compiled}, nil
+	}
+	return Matcher{pattern: pattern}, nil
+}
+
+// Match reports whether s matches
+func (m Matcher) Match(s string) bool {
+	if m.regexp != nil {
+		return m.regexp.MatchString(s)
+	}
+	return GlobMatch(m.pattern, s)
+}
+
+// Expand replaces $1 style references in template with the groups of a regular expression
+// matching s, templates of other matchers are returned as is
+func (m Matcher) Expand(template string, s string) string {
+	if m.regexp == nil {
+		return template
+	}
+	match := m.regexp.FindStringSubmatchIndex(s)
+	if match == nil {
+		return template
+	}
+	return string(m.regexp.ExpandString(nil, template, s, match))
+}
+
+func (m Matcher) String() string {
+	return m.pattern
+}
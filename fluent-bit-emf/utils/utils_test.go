@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	testCases := []struct {
+		pattern  string
+		input    string
+		expected bool
+	}{
+		{"*", "", true},
+		{"*", "MyService/api", true},
+		{"MyService/*", "MyService/api/v2", true},
+		{"MyService/*", "Other/api", false},
+		{"*Latency", "RequestLatency", true},
+		{"Lat?ncy", "Latency", true},
+		{"Lat?ncy", "Latncy", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+
+	for _, tc := range testCases {
+		if result := GlobMatch(tc.pattern, tc.input); result != tc.expected {
+			t.Errorf("GlobMatch(%q, %q): expected %v, got %v", tc.pattern, tc.input, tc.expected, result)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	testCases := []struct {
+		pattern  string
+		input    string
+		expected bool
+	}{
+		{"Latency", "Latency", true},
+		{"Latency", "RequestLatency", false},
+		{"*Latency", "RequestLatency", true},
+		{"/(Get|Put)Latency/", "GetLatency", true},
+		{"/(Get|Put)Latency/", "GetLatencyP99", false},
+		{"/Latency/", "RequestLatency", false},
+		{"/", "/", true},
+	}
+
+	for _, tc := range testCases {
+		matcher, err := ParseMatcher(tc.pattern)
+		if err != nil {
+			t.Fatalf("ParseMatcher(%q): expected no error, got %v", tc.pattern, err)
+		}
+		if result := matcher.Match(tc.input); result != tc.expected {
+			t.Errorf("Match(%q, %q): expected %v, got %v", tc.pattern, tc.input, tc.expected, result)
+		}
+	}
+
+	matcher, _ := ParseMatcher("/(.*)Latency/")
+	if expanded := matcher.Expand("$1.Latency", "GetLatency"); expanded != "Get.Latency" {
+		t.Errorf("Expected the group to be expanded, got %q", expanded)
+	}
+	glob, _ := ParseMatcher("*Latency")
+	if expanded := glob.Expand("$1.Latency", "GetLatency"); expanded != "$1.Latency" {
+		t.Errorf("Expected a glob to leave the template, got %q", expanded)
+	}
+	if _, err := ParseMatcher("/(/"); err == nil {
+		t.Errorf("Expected an error for an invalid regular expression")
+	}
+}
+
+func TestRoundToSignificantDigits(t *testing.T) {
+	testCases := []struct {
+		input    float64
+		digits   int
+		expected float64
+	}{
+		{1234.5678, 2, 1200},
+		{0.00012345, 3, 0.000123},
+		{-987.6, 1, -1000},
+		{0.1 + 0.2, 3, 0.3},
+		{42, 0, 42},
+	}
+
+	for _, tc := range testCases {
+		if result := RoundToSignificantDigits(tc.input, tc.digits); result != tc.expected {
+			t.Errorf("RoundToSignificantDigits(%v, %d): expected %v, got %v", tc.input, tc.digits, tc.expected, result)
+		}
+	}
+}
+
+func TestParseFloat64(t *testing.T) {
+	testCases := []struct {
+		input    interface{}
+		expected float64
+	}{
+		{float64(1.5), 1.5},
+		{float32(0.5), 0.5},
+		{int8(-3), -3},
+		{int32(7), 7},
+		{uint64(1 << 60), 1 << 60},
+		{uint8(255), 255},
+		{true, 1},
+		{false, 0},
+		{json.Number("12.5"), 12.5},
+		{" 42 ", 42},
+		{[]byte("3e2"), 300},
+	}
+	for _, tc := range testCases {
+		if result, err := ParseFloat64(tc.input); err != nil || result != tc.expected {
+			t.Errorf("ParseFloat64(%#v): expected %v, got %v (%v)", tc.input, tc.expected, result, err)
+		}
+	}
+
+	for _, input := range []interface{}{nil, "abc", json.Number("x"), []interface{}{1}, map[string]int{},
+		"NaN", "Inf", "+Infinity", "-inf", []byte("nan"), json.Number("Infinity"), math.NaN(), float32(math.Inf(-1))} {
+		if _, err := ParseFloat64(input); !errors.Is(err, ErrNotNumeric) {
+			t.Errorf("ParseFloat64(%#v): expected %v, got %v", input, ErrNotNumeric, err)
+		}
+		if result := ConvertToFloat64(input); result != 0 {
+			t.Errorf("ConvertToFloat64(%#v): expected 0, got %v", input, result)
+		}
+	}
+}
+
+func TestParseUint64(t *testing.T) {
+	testCases := []struct {
+		input    interface{}
+		expected uint64
+	}{
+		{uint64(math.MaxUint64), math.MaxUint64},
+		{int16(3), 3},
+		{float64(2), 2},
+		{true, 1},
+		{"18446744073709551615", math.MaxUint64},
+		{"2.0", 2},
+		{json.Number("1e3"), 1000},
+	}
+	for _, tc := range testCases {
+		if result, err := ParseUint64(tc.input); err != nil || result != tc.expected {
+			t.Errorf("ParseUint64(%#v): expected %v, got %v (%v)", tc.input, tc.expected, result, err)
+		}
+	}
+
+	for _, input := range []interface{}{nil, "abc", int64(-1), float64(-2), float64(1.5), float64(math.MaxUint64), math.NaN()} {
+		if _, err := ParseUint64(input); !errors.Is(err, ErrNotNumeric) {
+			t.Errorf("ParseUint64(%#v): expected %v, got %v", input, ErrNotNumeric, err)
+		}
+	}
+	if result := ConvertToUint64(float64(1.5)); result != 1 {
+		t.Errorf("ConvertToUint64(1.5): expected 1, got %v", result)
+	}
+}